@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"ripper-api/store"
+)
+
+const (
+	ActionSubmit   = "submit"
+	ActionDownload = "download"
+)
+
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	KeyId      string    `json:"keyId"`
+	IP         string    `json:"ip"`
+	RequestId  string    `json:"requestId"`
+	AlbumId    string    `json:"albumId,omitempty"`
+	Storefront string    `json:"storefront,omitempty"`
+	JobId      string    `json:"jobId,omitempty"`
+	QueueId    string    `json:"queueId,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// Log appends events to a JSON lines file and/or a Redis stream, whichever are enabled
+type Log struct {
+	mu     sync.Mutex
+	file   *os.File
+	store  *store.Store
+	stream bool
+}
+
+// Open starts an audit log writing to the file at path and, if stream is set, to the Redis stream of st.
+// An empty path disables the file
+func Open(path string, st *store.Store, stream bool) (*Log, error) {
+	l := &Log{store: st, stream: stream}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+	}
+	return l, nil
+}
+
+func (l *Log) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Enabled reports whether events go anywhere
+func (l *Log) Enabled() bool {
+	return l.file != nil || l.stream
+}
+
+func (l *Log) Record(ctx context.Context, e *Event) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if l.file != nil {
+		l.mu.Lock()
+		_, err := l.file.Write(append(raw, '\n'))
+		l.mu.Unlock()
+		errs = append(errs, err)
+	}
+	if l.stream {
+		errs = append(errs, l.store.AddAuditEvent(ctx, raw))
+	}
+	return errors.Join(errs...)
+}
+
+// Query returns up to limit events between from and to, optionally only the ones of keyId.
+// The stream is used when enabled, since it can be searched by time
+func (l *Log) Query(ctx context.Context, keyId string, from time.Time, to time.Time, limit int) ([]Event, error) {
+	events := make([]Event, 0)
+	keep := func(raw []byte) (bool, error) {
+		var e Event
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return false, err
+		}
+		if (keyId != "" && e.KeyId != keyId) || e.Time.Before(from) || e.Time.After(to) {
+			return true, nil
+		}
+		events = append(events, e)
+		return len(events) < limit, nil
+	}
+
+	if l.stream {
+		err := l.store.AuditEvents(ctx, from, to, keep)
+		return events, err
+	}
+
+	if l.file == nil {
+		return events, nil
+	}
+
+	f, err := os.Open(l.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		more, err := keep(scanner.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	return events, scanner.Err()
+}
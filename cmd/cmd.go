@@ -8,104 +8,296 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"ripper-api/queue"
 	"ripper-api/ripper"
 	"ripper-api/server"
+	"ripper-api/store"
 
 	"github.com/hibiken/asynq"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
 	"github.com/urfave/cli/v2"
 )
 
+// serve runs the HTTP api and the worker in one process
 func serve(cCtx *cli.Context) error {
+	return run(cCtx, true, true)
+}
+
+// serveApi only runs the HTTP api, jobs are left to workers elsewhere
+func serveApi(cCtx *cli.Context) error {
+	return run(cCtx, true, false)
+}
+
+// serveWorker only rips, the results are served by an api sharing the web folder
+func serveWorker(cCtx *cli.Context) error {
+	return run(cCtx, false, true)
+}
+
+func run(cCtx *cli.Context, api bool, worker bool) error {
 	serverConfig, err := initConfig(cCtx)
 	if err != nil {
 		return err
 	}
+	if api && len(serverConfig.KeyList) == 0 {
+		return errors.New("the api needs a file with api keys, see key-db or Keyfile")
+	}
 	err = os.MkdirAll(serverConfig.WebDir, os.ModePerm)
 	if err != nil && os.IsNotExist(err) {
 		return err
 	}
 
-	logger := initLogger()
+	logger, err := initLogger(serverConfig.LogFormat, serverConfig.LogLevel)
+	if err != nil {
+		return err
+	}
 
-	queues := make(map[string]int)
+	ripper.ApiUrl = strings.TrimSuffix(serverConfig.ApiUrl, "/")
+	ripper.WebPlayerUrl = strings.TrimSuffix(serverConfig.WebPlayerUrl, "/")
 
-	for i := range len(serverConfig.Wrappers) {
-		queues[fmt.Sprintf("%v", i)] = 3
+	backend := queue.Redis(serverConfig.Redis)
+	if serverConfig.Backend == queue.BackendEmbedded {
+		if !api || !worker {
+			return errors.New("the embedded backend only runs with serve, separate api and worker processes need Redis")
+		}
+		backend, err = queue.OpenEmbedded(serverConfig.DataFile, logger.With().Str("component", "backend").Logger())
+		if err != nil {
+			return err
+		}
 	}
+	defer func() {
+		if err := backend.Close(); err != nil {
+			logger.Error().Err(err).Msg("Error closing the backend")
+		}
+	}()
+	serverConfig.Redis = backend.ConnOpt()
 
-	qsrv := asynq.NewServer(
-		asynq.RedisClientOpt{
-			Addr:     serverConfig.AddressRedis,
-			Password: serverConfig.RedisPw,
-			DB:       0,
-		},
-		asynq.Config{
-			Concurrency: len(serverConfig.Wrappers),
-			Queues:      queues,
-		},
-	)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx = logger.WithContext(ctx)
+	defer stop()
 
-	mux := asynq.NewServeMux()
-	mux.HandleFunc(ripper.TypeRip, ripper.HandleProcessTask)
-	mux.HandleFunc(ripper.TypeInit, ripper.HandleInitQueueTask)
-	mux.HandleFunc(ripper.TypeDelete, ripper.HandleDeleteTask)
+	// the api is set up first, so nothing has to be stopped again if that fails
+	var e *echo.Echo
+	var srv *http.Server
+	var closeApi func()
+	if api {
+		e, srv, closeApi, err = server.CreateEchoWithServer(
+			logger.With().Str("component", "server").Logger().WithContext(ctx),
+			serverConfig,
+		)
+		if err != nil {
+			return err
+		}
+	}
 
-	// start asynq server
-	go func() {
-		if err := qsrv.Run(mux); err != nil {
-			logger.Fatal().
-				AnErr("error", err).
-				Msg("Error starting Asynq server")
+	var stopWorker func(context.Context)
+	if worker {
+		stopWorker, err = startWorker(ctx, serverConfig, logger)
+		if err != nil {
+			if closeApi != nil {
+				closeApi()
+			}
+			return err
 		}
-	}()
+	}
+
+	if api {
+		// start the http server
+		go func() {
+			if err := e.StartServer(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal().
+					AnErr("error", err).
+					Msg("Error starting HTTP listener")
+			}
+		}()
+	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	<-ctx.Done()
+	// a second signal kills the process
+	stop()
+	logger.Info().
+		Dur("timeout", serverConfig.ShutdownTimeout).
+		Msg("Attempting graceful shutdown, Ctrl+C to force")
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
 	ctx = logger.WithContext(ctx)
-	defer stop()
+	defer cancel()
 
-	e, srv := server.CreateEchoWithServer(
-		logger.With().Str("component", "server").Logger().WithContext(ctx),
-		serverConfig,
+	// downloads and rips drain side by side, within the same deadline
+	var wg sync.WaitGroup
+	if e != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// trigger echo graceful shutdown
+			if err := e.Shutdown(ctx); err != nil {
+				logger.Error().
+					AnErr("error", err).
+					Msg("Error while shutting down the HTTP listener")
+			}
+			closeApi()
+		}()
+	}
+	if stopWorker != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopWorker(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// startWorker starts the asynq servers and the scheduler, the returned func drains and shuts them down again
+func startWorker(ctx context.Context, serverConfig *server.Config, logger zerolog.Logger) (func(context.Context), error) {
+	queues := make(map[string]int)
+	trackQueues := make(map[string]int)
+	for priority, weight := range ripper.Priorities {
+		if configured, ok := serverConfig.QueueWeights[priority]; ok {
+			weight = configured
+		}
+		queues[ripper.QueueName(priority)] = weight
+		trackQueues[ripper.TrackQueueName(priority)] = weight
+	}
+
+	scheduler := asynq.NewScheduler(
+		serverConfig.Redis,
+		nil,
+	)
+
+	collectTask, err := ripper.NewCollectTask()
+	if err != nil {
+		return nil, err
+	}
+	_, err = scheduler.Register(
+		fmt.Sprintf("@every %v", serverConfig.CollectInterval),
+		collectTask,
+		asynq.Queue(ripper.MaintenanceQueue),
+		asynq.Unique(serverConfig.CollectInterval),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	probeTask, err := ripper.NewProbeTask()
+	if err != nil {
+		return nil, err
+	}
+	_, err = scheduler.Register(
+		fmt.Sprintf("@every %v", serverConfig.ProbeInterval),
+		probeTask,
+		asynq.Queue(ripper.MaintenanceQueue),
+		asynq.Unique(serverConfig.ProbeInterval),
 	)
+	if err != nil {
+		return nil, err
+	}
 
-	// start the http server
+	st, err := store.New(serverConfig.Redis)
+	if err != nil {
+		return nil, err
+	}
+
+	insp := asynq.NewInspector(serverConfig.Redis)
+
+	client := asynq.NewClient(serverConfig.Redis)
+
+	// configured wrappers join the pool, the pool itself lives in Redis and can be changed at runtime
+	if err := st.RegisterWrappers(context.Background(), serverConfig.Wrappers); err != nil {
+		return nil, err
+	}
+
+	handler := &ripper.TaskHandler{
+		Store:       st,
+		Client:      client,
+		Inspector:   insp,
+		WebDir:      serverConfig.WebDir,
+		CacheBudget: int64(serverConfig.CacheSize) << 20,
+		OrphanTTL:   serverConfig.OrphanTTL,
+
+		ProbeTimeout:    serverConfig.ProbeTimeout,
+		QuarantineAfter: serverConfig.QuarantineAfter,
+	}
+	if err := handler.SyncCache(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := handler.CleanPartial(logger.WithContext(context.Background())); err != nil {
+		return nil, err
+	}
+
+	mux := asynq.NewServeMux()
+	mux.HandleFunc(ripper.TypeRip, handler.HandleProcessTask)
+	mux.HandleFunc(ripper.TypeTrack, handler.HandleTrackTask)
+	mux.HandleFunc(ripper.TypeInit, ripper.HandleInitQueueTask)
+	mux.HandleFunc(ripper.TypeCollect, handler.HandleCollectTask)
+	mux.HandleFunc(ripper.TypeProbe, handler.HandleProbeTask)
+
+	// maintenance has its own server, albums hold their workers for the whole rip and would starve the probes
+	maintenance := asynq.NewServer(serverConfig.Redis, asynq.Config{
+		Concurrency:     maintenanceConcurrency,
+		Queues:          map[string]int{ripper.MaintenanceQueue: 1},
+		ShutdownTimeout: abortTimeout,
+		BaseContext: func() context.Context {
+			return logger.With().Str("component", "maintenance").Logger().WithContext(context.Background())
+		},
+	})
+	if err := maintenance.Start(mux); err != nil {
+		return nil, err
+	}
+
+	// start asynq server
+	qsrv := &workers{
+		opt: serverConfig.Redis,
+		config: asynq.Config{
+			Queues:         queues,
+			StrictPriority: serverConfig.StrictPriority,
+			RetryDelayFunc: ripper.RetryDelay,
+			BaseContext: func() context.Context {
+				return logger.With().Str("component", "worker").Logger().WithContext(context.Background())
+			},
+		},
+		trackConfig: asynq.Config{
+			Queues:         trackQueues,
+			StrictPriority: serverConfig.StrictPriority,
+			RetryDelayFunc: ripper.RetryDelay,
+			BaseContext: func() context.Context {
+				return logger.With().Str("component", "worker").Logger().WithContext(context.Background())
+			},
+		},
+		mux:    mux,
+		store:  st,
+		logger: logger,
+	}
+	if err := qsrv.start(context.Background()); err != nil {
+		maintenance.Shutdown()
+		return nil, err
+	}
+
+	// start asynq scheduler
 	go func() {
-		if err := e.StartServer(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := scheduler.Run(); err != nil {
 			logger.Fatal().
 				AnErr("error", err).
-				Msg("Error starting HTTP listener")
+				Msg("Error starting Asynq scheduler")
 		}
 	}()
-	select {
-	case <-ctx.Done():
-		logger.Info().Msg("Attempting graceful shutdown, Ctrl+C to force")
-
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		ctx = logger.WithContext(ctx)
-		defer cancel()
 
-		// trigger echo graceful shutdown
-		if err := e.Shutdown(ctx); err != nil {
-			logger.Fatal().
-				AnErr("error", err).
-				Msg("Error while shutting down")
-		}
-		qsrv.Stop()
-		qsrv.Shutdown()
-		logger.Info().Msg("Removing everything from web folder")
-		err = os.RemoveAll(serverConfig.WebDir)
-		if err != nil {
-			return err
-		}
-		err = os.MkdirAll(serverConfig.WebDir, os.ModePerm)
-		if err != nil {
-			return err
-		}
+	go qsrv.watch(ctx)
 
-		return nil
-	}
+	return func(ctx context.Context) {
+		scheduler.Shutdown()
+		maintenance.Shutdown()
+		qsrv.shutdown(ctx)
+		client.Close()
+		insp.Close()
+		st.Close()
+	}, nil
 }
 
 func Start() {
@@ -113,7 +305,7 @@ func Start() {
 		Name:        "ripper-api",
 		Usage:       "Web server for amusic ripping",
 		Description: "Web server with alac ripping, coverting and removing padding. Works with frida server and amusic wrapper",
-		UsageText:   "ripper-api [flags]",
+		UsageText:   "ripper-api [flags] [command]",
 		Flags: []cli.Flag{
 			&cli.UintFlag{
 				Name:    "port",
@@ -131,7 +323,7 @@ func Start() {
 			},
 			&cli.StringFlag{
 				Name:    "web-dir",
-				Usage:   "Temporary directory for content serving",
+				Usage:   "Directory for ripped and cached content",
 				EnvVars: []string{"WEB_DIR"},
 				Aliases: []string{"d"},
 			},
@@ -141,12 +333,174 @@ func Start() {
 				EnvVars: []string{"WRAPPERS"},
 				Aliases: []string{"w"},
 			},
+			&cli.UintFlag{
+				Name:    "cache-size",
+				Usage:   "Disk space in MiB for cached results in the web folder, 0 for no limit",
+				Value:   uint(10240),
+				EnvVars: []string{"CACHE_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    "orphan-ttl",
+				Usage:   "Age after which results not referenced by a job or the cache are removed",
+				Value:   24 * time.Hour,
+				EnvVars: []string{"ORPHAN_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "collect-interval",
+				Usage:   "Interval between scans of the web folder for orphaned results",
+				Value:   10 * time.Minute,
+				EnvVars: []string{"COLLECT_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "probe-interval",
+				Usage:   "Interval between wrapper health probes",
+				Value:   30 * time.Second,
+				EnvVars: []string{"PROBE_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "probe-timeout",
+				Usage:   "How long a wrapper may take to answer a health probe",
+				Value:   5 * time.Second,
+				EnvVars: []string{"PROBE_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "quarantine-after",
+				Usage:   "Failed health probes in a row after which a wrapper gets no new rips",
+				Value:   2,
+				EnvVars: []string{"QUARANTINE_AFTER"},
+			},
+			&cli.StringFlag{
+				Name:    "priority-keys",
+				Usage:   "File with api keys allowed to submit high priority jobs",
+				EnvVars: []string{"PRIORITY_KEYS"},
+			},
+			&cli.BoolFlag{
+				Name:    "strict-priority",
+				Usage:   "Always run higher priority jobs first instead of weighting the queues",
+				EnvVars: []string{"STRICT_PRIORITY"},
+			},
+			&cli.DurationFlag{
+				Name:    "retention",
+				Usage:   "How long finished jobs can be queried",
+				Value:   time.Hour,
+				EnvVars: []string{"RETENTION"},
+			},
+			&cli.DurationFlag{
+				Name:    "max-retention",
+				Usage:   "Upper limit for the retention requested by a job",
+				Value:   24 * time.Hour,
+				EnvVars: []string{"MAX_RETENTION"},
+			},
+			&cli.DurationFlag{
+				Name:    "result-ttl",
+				Usage:   "How long results are kept after their last download, 0 keeps them until the cache is full",
+				EnvVars: []string{"RESULT_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "max-result-ttl",
+				Usage:   "Upper limit for the result TTL requested by a job",
+				Value:   30 * 24 * time.Hour,
+				EnvVars: []string{"MAX_RESULT_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Usage:   "How long a rip may run before it's cancelled, 0 for asynq's default of 30m",
+				Value:   2 * time.Hour,
+				EnvVars: []string{"TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "max-timeout",
+				Usage:   "Upper limit for the timeout or deadline requested by a job",
+				Value:   6 * time.Hour,
+				EnvVars: []string{"MAX_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "max-retry",
+				Usage:   "How often a failed rip is retried",
+				Value:   3,
+				EnvVars: []string{"MAX_RETRY"},
+			},
+			&cli.IntFlag{
+				Name:    "max-retry-limit",
+				Usage:   "Upper limit for the retries requested by a job",
+				Value:   10,
+				EnvVars: []string{"MAX_RETRY_LIMIT"},
+			},
+			&cli.DurationFlag{
+				Name:    "idempotency-window",
+				Usage:   "How long responses are kept for replays of an Idempotency-Key",
+				Value:   24 * time.Hour,
+				EnvVars: []string{"IDEMPOTENCY_WINDOW"},
+			},
+			&cli.DurationFlag{
+				Name:    "job-history",
+				Usage:   "How long job records are kept after submission, 0 keeps them forever",
+				Value:   90 * 24 * time.Hour,
+				EnvVars: []string{"JOB_HISTORY"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "How long running rips and downloads may take to finish on shutdown, unfinished rips resume on the next start",
+				Value:   5 * time.Minute,
+				EnvVars: []string{"SHUTDOWN_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-keys",
+				Usage:   "File with api keys allowed to use the admin endpoints",
+				EnvVars: []string{"ADMIN_KEYS"},
+			},
+			&cli.StringFlag{
+				Name:    "audit-log",
+				Usage:   "File to append audit events of submissions and downloads to",
+				EnvVars: []string{"AUDIT_LOG"},
+			},
+			&cli.BoolFlag{
+				Name:    "audit-stream",
+				Usage:   "Also write audit events to a Redis stream",
+				EnvVars: []string{"AUDIT_STREAM"},
+			},
+			&cli.StringFlag{
+				Name:    "log-format",
+				Usage:   "Log output format, console or json",
+				Value:   "console",
+				EnvVars: []string{"LOG_FORMAT"},
+			},
+			&cli.StringFlag{
+				Name:    "log-level",
+				Usage:   "Minimum level to log, one of trace, debug, info, warn, error",
+				Value:   "info",
+				EnvVars: []string{"LOG_LEVEL"},
+			},
+			&cli.StringFlag{
+				Name:    "api-url",
+				Usage:   "Base URL of the catalog API",
+				Value:   ripper.ApiUrl,
+				EnvVars: []string{"API_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "web-player-url",
+				Usage:   "URL of the web player the developer token is scraped from",
+				Value:   ripper.WebPlayerUrl,
+				EnvVars: []string{"WEB_PLAYER_URL"},
+			},
 			&cli.StringFlag{
 				Name:    "key-db",
 				Usage:   "File with valid api keys",
 				EnvVars: []string{"KEY_DB"},
 				Aliases: []string{"k"},
 			},
+			&cli.StringFlag{
+				Name:    "backend",
+				Usage:   "Where queues and state are kept, redis or embedded to try ripper-api out without Redis (not for production)",
+				Value:   queue.BackendRedis,
+				EnvVars: []string{"BACKEND"},
+			},
+			&cli.StringFlag{
+				Name:    "data-file",
+				Usage:   "File the embedded backend keeps its data in",
+				Value:   "ripper-api.json",
+				EnvVars: []string{"DATA_FILE"},
+			},
 			&cli.StringFlag{
 				Name:    "redis",
 				Usage:   "Address and port of redis",
@@ -160,6 +514,61 @@ func Start() {
 				EnvVars: []string{"REDIS_PASSWORD"},
 				Aliases: []string{"pw"},
 			},
+			&cli.StringFlag{
+				Name:    "redis-user",
+				Usage:   "Redis ACL username",
+				EnvVars: []string{"REDIS_USERNAME"},
+			},
+			&cli.IntFlag{
+				Name:    "redis-db",
+				Usage:   "Redis DB index",
+				EnvVars: []string{"REDIS_DB"},
+			},
+			&cli.BoolFlag{
+				Name:    "redis-tls",
+				Usage:   "Connect to redis over TLS",
+				EnvVars: []string{"REDIS_TLS"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-ca",
+				Usage:   "CA certificate file to verify redis with, implies redis-tls",
+				EnvVars: []string{"REDIS_CA"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-cert",
+				Usage:   "Client certificate file for redis, implies redis-tls",
+				EnvVars: []string{"REDIS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-key",
+				Usage:   "Key file of the redis client certificate",
+				EnvVars: []string{"REDIS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-server-name",
+				Usage:   "Name to verify the redis certificate against, if it's not the address",
+				EnvVars: []string{"REDIS_SERVER_NAME"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-sentinel-master",
+				Usage:   "Name of the master to get from redis Sentinel",
+				EnvVars: []string{"REDIS_SENTINEL_MASTER"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "redis-sentinels",
+				Usage:   "Addresses and ports of the redis Sentinels",
+				EnvVars: []string{"REDIS_SENTINELS"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-sentinel-pw",
+				Usage:   "Password of the redis Sentinels",
+				EnvVars: []string{"REDIS_SENTINEL_PASSWORD"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "redis-cluster",
+				Usage:   "Addresses and ports of redis Cluster nodes, instead of a single redis",
+				EnvVars: []string{"REDIS_CLUSTER"},
+			},
 			&cli.PathFlag{
 				Name:    "config",
 				Usage:   "Path for config file",
@@ -169,6 +578,24 @@ func Start() {
 			},
 		},
 		Action: serve,
+		Commands: []*cli.Command{
+			{
+				Name:   "serve",
+				Usage:  "Run the HTTP api and the worker in one process, the default without a command",
+				Action: serve,
+			},
+			{
+				Name:   "api",
+				Usage:  "Only run the HTTP api, jobs are ripped by separate workers",
+				Action: serveApi,
+			},
+			{
+				Name:   "worker",
+				Usage:  "Only rip jobs, the results are served by a separate api",
+				Action: serveWorker,
+			},
+			wrapperCommand,
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
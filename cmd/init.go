@@ -2,26 +2,110 @@ package cmd
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
+	"io"
 	"log"
 	"os"
 	"time"
 
+	"ripper-api/queue"
+	"ripper-api/ripper"
 	"ripper-api/server"
+	"ripper-api/store"
 
 	"github.com/BurntSushi/toml"
 	"github.com/rs/zerolog"
 )
 
 type Config struct {
-	Port         uint     `toml:"Port"`
-	Address      string   `toml:"Address"`
-	AddressRedis string   `toml:"Redis"`
-	Wrappers     []string `toml:"Wrappers"`
-	WebDir       string   `toml:"Webdir"`
-	RedisPw      string   `toml:"RedisPw"`
-	Keyfile      string   `toml:"Keyfile"`
+	Port         uint      `toml:"Port"`
+	Address      string    `toml:"Address"`
+	AddressRedis string    `toml:"Redis"`
+	Wrappers     []string  `toml:"Wrappers"`
+	WebDir       string    `toml:"Webdir"`
+	CacheSize    *uint     `toml:"CacheSize"`
+	OrphanTTL    *duration `toml:"OrphanTTL"`
+	Collect      *duration `toml:"CollectInterval"`
+	RedisPw      string    `toml:"RedisPw"`
+	Keyfile      string    `toml:"Keyfile"`
+	ApiUrl       string    `toml:"ApiUrl"`
+	WebPlayerUrl string    `toml:"WebPlayerUrl"`
+	PriorityKeys string    `toml:"PriorityKeyfile"`
+	Strict       bool      `toml:"StrictPriority"`
+	Retention    *duration `toml:"Retention"`
+	MaxRetention *duration `toml:"MaxRetention"`
+	ResultTTL    *duration `toml:"ResultTTL"`
+	MaxResultTTL *duration `toml:"MaxResultTTL"`
+	Timeout      *duration `toml:"Timeout"`
+	MaxTimeout   *duration `toml:"MaxTimeout"`
+	MaxRetry     *int      `toml:"MaxRetry"`
+	RetryLimit   *int      `toml:"MaxRetryLimit"`
+	Idempotency  *duration `toml:"IdempotencyWindow"`
+	JobHistory   *duration `toml:"JobHistory"`
+	Shutdown     *duration `toml:"ShutdownTimeout"`
+	AdminKeys    string    `toml:"AdminKeyfile"`
+	AuditLog     string    `toml:"AuditLog"`
+	AuditStream  bool      `toml:"AuditStream"`
+	LogFormat    string    `toml:"LogFormat"`
+	ProbeEvery   *duration `toml:"ProbeInterval"`
+	ProbeTimeout *duration `toml:"ProbeTimeout"`
+	Quarantine   *int      `toml:"QuarantineAfter"`
+	LogLevel     string    `toml:"LogLevel"`
+
+	RedisUser       string   `toml:"RedisUsername"`
+	RedisDB         int      `toml:"RedisDB"`
+	RedisTLS        bool     `toml:"RedisTLS"`
+	RedisCA         string   `toml:"RedisCA"`
+	RedisCert       string   `toml:"RedisCert"`
+	RedisKey        string   `toml:"RedisKey"`
+	RedisServerName string   `toml:"RedisServerName"`
+	SentinelMaster  string   `toml:"RedisSentinelMaster"`
+	Sentinels       []string `toml:"RedisSentinels"`
+	SentinelPw      string   `toml:"RedisSentinelPw"`
+	RedisCluster    []string `toml:"RedisCluster"`
+	Backend         string   `toml:"Backend"`
+	DataFile        string   `toml:"DataFile"`
+
+	// tables have to come after the keys above in the file
+	Wrapper      []wrapper      `toml:"wrapper"`
+	QueueWeights map[string]int `toml:"QueueWeights"`
+}
+
+// wrapper is a [[wrapper]] table, for wrappers that need more than the defaults of Wrappers
+type wrapper struct {
+	Address string   `toml:"Address"`
+	Slots   int      `toml:"Slots"`
+	Weight  int      `toml:"Weight"`
+	Labels  []string `toml:"Labels"`
+}
+
+// duration reads TOML strings like "1h30m"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// orFlag returns the config file value if it's set, and the value of the flag otherwise
+func orFlag[T any](value *T, flag T) T {
+	if value != nil {
+		return *value
+	}
+	return flag
+}
+
+// durationOrFlag is orFlag for durations
+func durationOrFlag(value *duration, flag time.Duration) time.Duration {
+	if value != nil {
+		return value.Duration
+	}
+	return flag
 }
 
 func readLines(path string) ([]string, error) {
@@ -44,54 +128,243 @@ func readLines(path string) ([]string, error) {
 	return lines, scanner.Err()
 }
 
+// readOptionalLines is readLines for files that don't have to be configured
+func readOptionalLines(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return readLines(path)
+}
+
+// poolWrappers merges the plain wrapper addresses, which get one slot, with the [[wrapper]] tables
+func poolWrappers(addrs []string, tables []wrapper) (map[string]store.Wrapper, error) {
+	wrappers := make(map[string]store.Wrapper, len(addrs)+len(tables))
+	for _, addr := range addrs {
+		wrappers[addr] = store.Wrapper{Slots: 1, Weight: 1}
+	}
+	for _, w := range tables {
+		if w.Address == "" {
+			return nil, errors.New("a [[wrapper]] needs an Address")
+		}
+		if w.Slots < 0 || w.Weight < 0 {
+			return nil, fmt.Errorf("wrapper %s: Slots and Weight can't be negative", w.Address)
+		}
+		for _, label := range w.Labels {
+			if _, ok := ripper.Priorities[label]; !ok {
+				return nil, fmt.Errorf("wrapper %s: unknown label %q, labels are priorities", w.Address, label)
+			}
+		}
+		wrappers[w.Address] = store.Wrapper{Slots: max(w.Slots, 1), Weight: max(w.Weight, 1), Labels: w.Labels}
+	}
+	return wrappers, nil
+}
+
+// queueWeights checks that the configured weights are for known priorities
+func queueWeights(weights map[string]int) (map[string]int, error) {
+	for priority, weight := range weights {
+		if _, ok := ripper.Priorities[priority]; !ok {
+			return nil, fmt.Errorf("unknown priority %q in QueueWeights", priority)
+		}
+		if weight < 1 {
+			return nil, fmt.Errorf("the weight of %s needs to be at least 1", priority)
+		}
+	}
+	return weights, nil
+}
+
+// checkBackend checks that the backend is one of the known ones
+func checkBackend(backend string) error {
+	if backend != queue.BackendRedis && backend != queue.BackendEmbedded {
+		return fmt.Errorf("unknown backend %q, expected %s or %s", backend, queue.BackendRedis, queue.BackendEmbedded)
+	}
+	return nil
+}
+
 func initConfig(cCtx *cli.Context) (*server.Config, error) {
 	var conf Config
 	if cCtx.Path("config") != "" {
 		if _, err := toml.DecodeFile(cCtx.Path("config"), &conf); err != nil {
 			return nil, err
 		}
-		lines, err := readLines(conf.Keyfile)
+		lines, err := readOptionalLines(conf.Keyfile)
+		if err != nil {
+			return nil, err
+		}
+
+		apiUrl := cCtx.String("api-url")
+		if conf.ApiUrl != "" {
+			apiUrl = conf.ApiUrl
+		}
+		webPlayerUrl := cCtx.String("web-player-url")
+		if conf.WebPlayerUrl != "" {
+			webPlayerUrl = conf.WebPlayerUrl
+		}
+		logFormat := cCtx.String("log-format")
+		if conf.LogFormat != "" {
+			logFormat = conf.LogFormat
+		}
+		logLevel := cCtx.String("log-level")
+		if conf.LogLevel != "" {
+			logLevel = conf.LogLevel
+		}
+		priorityKeys, err := readOptionalLines(conf.PriorityKeys)
+		if err != nil {
+			return nil, err
+		}
+		adminKeys, err := readOptionalLines(conf.AdminKeys)
+		if err != nil {
+			return nil, err
+		}
+		wrappers, err := poolWrappers(conf.Wrappers, conf.Wrapper)
+		if err != nil {
+			return nil, err
+		}
+		redisOpt, err := conf.redis().connOpt()
+		if err != nil {
+			return nil, err
+		}
+		backend := cCtx.String("backend")
+		if conf.Backend != "" {
+			backend = conf.Backend
+		}
+		dataFile := cCtx.String("data-file")
+		if conf.DataFile != "" {
+			dataFile = conf.DataFile
+		}
+		if err := checkBackend(backend); err != nil {
+			return nil, err
+		}
+		weights, err := queueWeights(conf.QueueWeights)
 		if err != nil {
 			return nil, err
 		}
 
 		return &server.Config{
-				Port:         conf.Port,
-				Address:      conf.Address,
-				Wrappers:     conf.Wrappers,
-				WebDir:       conf.WebDir,
-				RedisPw:      conf.RedisPw,
-				AddressRedis: conf.AddressRedis,
-				KeyList:      lines},
+				Port:              conf.Port,
+				Address:           conf.Address,
+				Wrappers:          wrappers,
+				WebDir:            conf.WebDir,
+				Redis:             redisOpt,
+				Backend:           backend,
+				DataFile:          dataFile,
+				KeyList:           lines,
+				CacheSize:         orFlag(conf.CacheSize, cCtx.Uint("cache-size")),
+				OrphanTTL:         durationOrFlag(conf.OrphanTTL, cCtx.Duration("orphan-ttl")),
+				CollectInterval:   durationOrFlag(conf.Collect, cCtx.Duration("collect-interval")),
+				ApiUrl:            apiUrl,
+				WebPlayerUrl:      webPlayerUrl,
+				PriorityKeys:      priorityKeys,
+				StrictPriority:    conf.Strict,
+				QueueWeights:      weights,
+				Retention:         durationOrFlag(conf.Retention, cCtx.Duration("retention")),
+				MaxRetention:      durationOrFlag(conf.MaxRetention, cCtx.Duration("max-retention")),
+				ResultTTL:         durationOrFlag(conf.ResultTTL, cCtx.Duration("result-ttl")),
+				MaxResultTTL:      durationOrFlag(conf.MaxResultTTL, cCtx.Duration("max-result-ttl")),
+				Timeout:           durationOrFlag(conf.Timeout, cCtx.Duration("timeout")),
+				MaxTimeout:        durationOrFlag(conf.MaxTimeout, cCtx.Duration("max-timeout")),
+				MaxRetry:          orFlag(conf.MaxRetry, cCtx.Int("max-retry")),
+				MaxRetryLimit:     orFlag(conf.RetryLimit, cCtx.Int("max-retry-limit")),
+				IdempotencyWindow: durationOrFlag(conf.Idempotency, cCtx.Duration("idempotency-window")),
+				JobHistory:        durationOrFlag(conf.JobHistory, cCtx.Duration("job-history")),
+				ShutdownTimeout:   durationOrFlag(conf.Shutdown, cCtx.Duration("shutdown-timeout")),
+				AdminKeys:         adminKeys,
+				AuditLog:          conf.AuditLog,
+				AuditStream:       conf.AuditStream,
+				ProbeInterval:     durationOrFlag(conf.ProbeEvery, cCtx.Duration("probe-interval")),
+				ProbeTimeout:      durationOrFlag(conf.ProbeTimeout, cCtx.Duration("probe-timeout")),
+				QuarantineAfter:   orFlag(conf.Quarantine, cCtx.Int("quarantine-after")),
+				LogFormat:         logFormat,
+				LogLevel:          logLevel},
 			nil
 	} else {
-		lines, err := readLines(cCtx.String("key-db"))
+		lines, err := readOptionalLines(cCtx.String("key-db"))
+		if err != nil {
+			return nil, err
+		}
+
+		wrappers, err := poolWrappers(cCtx.StringSlice("wrappers"), nil)
+		if err != nil {
+			return nil, err
+		}
+		redisOpt, err := redisFlags(cCtx).connOpt()
 		if err != nil {
 			return nil, err
 		}
+		if err := checkBackend(cCtx.String("backend")); err != nil {
+			return nil, err
+		}
 
-		wrappers := cCtx.StringSlice("wrappers")
+		priorityKeys, err := readOptionalLines(cCtx.String("priority-keys"))
+		if err != nil {
+			return nil, err
+		}
+		adminKeys, err := readOptionalLines(cCtx.String("admin-keys"))
+		if err != nil {
+			return nil, err
+		}
 
 		return &server.Config{
-				Port:         cCtx.Uint("port"),
-				Address:      cCtx.String("address"),
-				Wrappers:     wrappers,
-				WebDir:       cCtx.String("web-dir"),
-				RedisPw:      cCtx.String("redis-pw"),
-				AddressRedis: cCtx.String("redis"),
-				KeyList:      lines},
+				Port:              cCtx.Uint("port"),
+				Address:           cCtx.String("address"),
+				Wrappers:          wrappers,
+				WebDir:            cCtx.String("web-dir"),
+				Redis:             redisOpt,
+				Backend:           cCtx.String("backend"),
+				DataFile:          cCtx.String("data-file"),
+				KeyList:           lines,
+				CacheSize:         cCtx.Uint("cache-size"),
+				OrphanTTL:         cCtx.Duration("orphan-ttl"),
+				CollectInterval:   cCtx.Duration("collect-interval"),
+				ApiUrl:            cCtx.String("api-url"),
+				WebPlayerUrl:      cCtx.String("web-player-url"),
+				PriorityKeys:      priorityKeys,
+				StrictPriority:    cCtx.Bool("strict-priority"),
+				Retention:         cCtx.Duration("retention"),
+				MaxRetention:      cCtx.Duration("max-retention"),
+				ResultTTL:         cCtx.Duration("result-ttl"),
+				MaxResultTTL:      cCtx.Duration("max-result-ttl"),
+				Timeout:           cCtx.Duration("timeout"),
+				MaxTimeout:        cCtx.Duration("max-timeout"),
+				MaxRetry:          cCtx.Int("max-retry"),
+				MaxRetryLimit:     cCtx.Int("max-retry-limit"),
+				IdempotencyWindow: cCtx.Duration("idempotency-window"),
+				JobHistory:        cCtx.Duration("job-history"),
+				ShutdownTimeout:   cCtx.Duration("shutdown-timeout"),
+				AdminKeys:         adminKeys,
+				AuditLog:          cCtx.String("audit-log"),
+				AuditStream:       cCtx.Bool("audit-stream"),
+				ProbeInterval:     cCtx.Duration("probe-interval"),
+				ProbeTimeout:      cCtx.Duration("probe-timeout"),
+				QuarantineAfter:   cCtx.Int("quarantine-after"),
+				LogFormat:         cCtx.String("log-format"),
+				LogLevel:          cCtx.String("log-level")},
 			nil
 	}
 }
 
-func initLogger() zerolog.Logger {
-	output := zerolog.ConsoleWriter{
-		Out:        os.Stdout,
-		TimeFormat: time.RFC3339,
+// initLogger sets up the logger in the configured format, either "console" or "json", and level
+func initLogger(format string, level string) (zerolog.Logger, error) {
+	var output io.Writer
+	switch format {
+	case "console":
+		output = zerolog.ConsoleWriter{
+			Out:        os.Stdout,
+			TimeFormat: time.RFC3339,
+		}
+	case "json":
+		output = os.Stdout
+	default:
+		return zerolog.Logger{}, fmt.Errorf("unknown log format %q", format)
 	}
-	logger := zerolog.New(output).With().Timestamp().Logger()
+
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return zerolog.Logger{}, err
+	}
+
+	logger := zerolog.New(output).Level(lvl).With().Timestamp().Logger()
 	log.SetFlags(0)
 	log.SetOutput(logger)
 
-	return logger
+	return logger, nil
 }
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"ripper-api/queue"
+	"ripper-api/store"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hibiken/asynq"
+	"github.com/urfave/cli/v2"
+)
+
+// clusterKeyPrefix puts all keys of the store in one hash slot, so the Lua scripts may touch any of them
+const clusterKeyPrefix = "{ripper-api}:"
+
+// redisConfig is how to reach Redis: a single server, a Sentinel setup or a Cluster
+type redisConfig struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+
+	TLS        bool
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+
+	// SentinelMaster switches to Sentinel failover, with the Sentinels at SentinelAddrs
+	SentinelMaster   string
+	SentinelAddrs    []string
+	SentinelPassword string
+
+	// ClusterAddrs switches to Cluster mode, Addr and DB are not used then
+	ClusterAddrs []string
+}
+
+// redisFlags returns the Redis settings of the flags
+func redisFlags(cCtx *cli.Context) redisConfig {
+	return redisConfig{
+		Addr:             cCtx.String("redis"),
+		Username:         cCtx.String("redis-user"),
+		Password:         cCtx.String("redis-pw"),
+		DB:               cCtx.Int("redis-db"),
+		TLS:              cCtx.Bool("redis-tls"),
+		CA:               cCtx.String("redis-ca"),
+		Cert:             cCtx.String("redis-cert"),
+		Key:              cCtx.String("redis-key"),
+		ServerName:       cCtx.String("redis-server-name"),
+		SentinelMaster:   cCtx.String("redis-sentinel-master"),
+		SentinelAddrs:    cCtx.StringSlice("redis-sentinels"),
+		SentinelPassword: cCtx.String("redis-sentinel-pw"),
+		ClusterAddrs:     cCtx.StringSlice("redis-cluster"),
+	}
+}
+
+// redis returns the Redis settings of the config file
+func (conf *Config) redis() redisConfig {
+	return redisConfig{
+		Addr:             conf.AddressRedis,
+		Username:         conf.RedisUser,
+		Password:         conf.RedisPw,
+		DB:               conf.RedisDB,
+		TLS:              conf.RedisTLS,
+		CA:               conf.RedisCA,
+		Cert:             conf.RedisCert,
+		Key:              conf.RedisKey,
+		ServerName:       conf.RedisServerName,
+		SentinelMaster:   conf.SentinelMaster,
+		SentinelAddrs:    conf.Sentinels,
+		SentinelPassword: conf.SentinelPw,
+		ClusterAddrs:     conf.RedisCluster,
+	}
+}
+
+// tlsConfig returns the TLS settings, or nil if TLS isn't used
+func (c redisConfig) tlsConfig() (*tls.Config, error) {
+	if !c.TLS && c.CA == "" && c.Cert == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// connOpt builds the asynq connection options shared by the queues and the store.
+// In Cluster mode the keys of the store are moved into a single hash slot
+func (c redisConfig) connOpt() (asynq.RedisConnOpt, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(c.ClusterAddrs) > 0:
+		if c.SentinelMaster != "" {
+			return nil, errors.New("redis can't be both a Cluster and behind Sentinel")
+		}
+		if c.DB != 0 {
+			return nil, errors.New("redis Cluster only has DB 0")
+		}
+		store.KeyPrefix = clusterKeyPrefix
+		return asynq.RedisClusterClientOpt{
+			Addrs:     c.ClusterAddrs,
+			Username:  c.Username,
+			Password:  c.Password,
+			TLSConfig: tlsConfig,
+		}, nil
+	case c.SentinelMaster != "":
+		if len(c.SentinelAddrs) == 0 {
+			return nil, errors.New("redis Sentinel needs the addresses of the Sentinels")
+		}
+		return asynq.RedisFailoverClientOpt{
+			MasterName:       c.SentinelMaster,
+			SentinelAddrs:    c.SentinelAddrs,
+			SentinelPassword: c.SentinelPassword,
+			Username:         c.Username,
+			Password:         c.Password,
+			DB:               c.DB,
+			TLSConfig:        tlsConfig,
+		}, nil
+	default:
+		return asynq.RedisClientOpt{
+			Addr:      c.Addr,
+			Username:  c.Username,
+			Password:  c.Password,
+			DB:        c.DB,
+			TLSConfig: tlsConfig,
+		}, nil
+	}
+}
+
+// errEmbedded is returned to commands that connect to a running instance, which the embedded backend doesn't allow
+var errEmbedded = errors.New("the embedded backend belongs to the running process, use its admin API instead")
+
+// redisConnOpt builds the connection options from the config file, or from the flags if there is none
+func redisConnOpt(cCtx *cli.Context) (asynq.RedisConnOpt, error) {
+	if cCtx.Path("config") == "" {
+		if cCtx.String("backend") == queue.BackendEmbedded {
+			return nil, errEmbedded
+		}
+		return redisFlags(cCtx).connOpt()
+	}
+	var conf Config
+	if _, err := toml.DecodeFile(cCtx.Path("config"), &conf); err != nil {
+		return nil, err
+	}
+	if conf.Backend == queue.BackendEmbedded {
+		return nil, errEmbedded
+	}
+	return conf.redis().connOpt()
+}
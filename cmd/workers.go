@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ripper-api/store"
+
+	"github.com/hibiken/asynq"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// poolCheckInterval is how often the worker looks for changes of the wrapper pool
+	poolCheckInterval = 10 * time.Second
+	// abortTimeout is how long asynq waits for rips still running after the drain before it requeues them
+	abortTimeout = time.Second
+	// maintenanceConcurrency lets a probe and a collection run side by side
+	maintenanceConcurrency = 2
+)
+
+// generation is a pair of asynq servers sized for the pool at the time they were started.
+// Albums and tracks have their own servers, so albums waiting for their tracks can't take all workers
+type generation struct {
+	srv    *asynq.Server
+	tracks *asynq.Server
+	active atomic.Int64
+	// albums counts the active tasks of srv
+	albums atomic.Int64
+}
+
+func (g *generation) stop() {
+	g.srv.Stop()
+	g.tracks.Stop()
+}
+
+func (g *generation) shutdown() {
+	g.srv.Shutdown()
+	g.tracks.Shutdown()
+}
+
+// workers runs an asynq server with a worker per wrapper slot. When wrappers are added or removed,
+// a server of the new size takes over and the old one is retired once its rips are done
+type workers struct {
+	opt    asynq.RedisConnOpt
+	config asynq.Config
+	// trackConfig is the config of the track server, Concurrency is set from the pool
+	trackConfig asynq.Config
+	mux         *asynq.ServeMux
+	store       *store.Store
+	logger      zerolog.Logger
+
+	mu      sync.Mutex
+	current *generation
+	slots   int
+	retired []*generation
+}
+
+// poolSlots counts the slots of the wrappers that take new rips
+func (w *workers) poolSlots(ctx context.Context) (int, error) {
+	pool, err := w.store.Wrappers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	draining, err := w.store.DrainingWrappers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, addr := range draining {
+		delete(pool, addr)
+	}
+
+	var slots int
+	for _, w := range pool {
+		slots += w.Slots
+	}
+	return slots, nil
+}
+
+func (w *workers) start(ctx context.Context) error {
+	slots, err := w.poolSlots(ctx)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.replace(slots)
+}
+
+// replace starts servers for the given number of slots and retires the current ones
+func (w *workers) replace(slots int) error {
+	config := w.config
+	// an album per wrapper slot, asynq would pick its own default for 0
+	config.Concurrency = max(slots, 1)
+	trackConfig := w.trackConfig
+	// a track per wrapper slot, asynq would pick its own default for 0
+	trackConfig.Concurrency = max(slots, 1)
+
+	// the workers drain on their own, what asynq still finds running is requeued right away
+	config.ShutdownTimeout = abortTimeout
+	trackConfig.ShutdownTimeout = abortTimeout
+
+	g := &generation{srv: asynq.NewServer(w.opt, config), tracks: asynq.NewServer(w.opt, trackConfig)}
+	handler := asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		g.active.Add(1)
+		defer g.active.Add(-1)
+		return w.mux.ProcessTask(ctx, t)
+	})
+	albumHandler := asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		g.albums.Add(1)
+		defer g.albums.Add(-1)
+		return handler.ProcessTask(ctx, t)
+	})
+	if err := g.srv.Start(albumHandler); err != nil {
+		return err
+	}
+	if err := g.tracks.Start(handler); err != nil {
+		g.srv.Shutdown()
+		return err
+	}
+
+	old := w.current
+	w.current, w.slots = g, slots
+	if old == nil {
+		return nil
+	}
+
+	// the old servers stop taking tasks but finish their rips, shutting them down right away would restart them
+	old.stop()
+	w.retired = append(w.retired, old)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if old.active.Load() == 0 {
+				old.shutdown()
+				w.mu.Lock()
+				w.retired = slices.DeleteFunc(w.retired, func(g *generation) bool { return g == old })
+				w.mu.Unlock()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// watch resizes the workers whenever the pool changes, until ctx is done
+func (w *workers) watch(ctx context.Context) {
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		slots, err := w.poolSlots(ctx)
+		if err != nil {
+			w.logger.Error().Err(err).Msg("Error reading the wrapper pool")
+			continue
+		}
+
+		w.mu.Lock()
+		if slots != w.slots {
+			w.logger.Info().Int("from", w.slots).Int("to", slots).Msg("Wrapper pool changed, resizing workers")
+			if err := w.replace(slots); err != nil {
+				w.logger.Error().Err(err).Msg("Error starting Asynq server")
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// shutdown stops taking new rips and lets the running ones finish until ctx is done. Rips still running then
+// are requeued, and pick up from the tracks already written once a worker is back
+func (w *workers) shutdown(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	generations := append([]*generation{w.current}, w.retired...)
+	// albums wait for their tracks, so tracks keep being ripped until the albums are done
+	for _, g := range generations {
+		g.srv.Stop()
+	}
+	drain(ctx, generations, func(g *generation) int64 { return g.albums.Load() })
+	for _, g := range generations {
+		g.tracks.Stop()
+	}
+	drain(ctx, generations, func(g *generation) int64 { return g.active.Load() })
+
+	for _, g := range generations {
+		g.shutdown()
+	}
+}
+
+// drain waits until running counts no tasks for any of the generations, or until ctx is done
+func drain(ctx context.Context, generations []*generation, running func(g *generation) int64) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var n int64
+		for _, g := range generations {
+			n += running(g)
+		}
+		if n == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
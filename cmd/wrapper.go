@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"ripper-api/ripper"
+	"ripper-api/store"
+
+	"github.com/urfave/cli/v2"
+)
+
+// openStore connects to the Redis of the config file, or of the flags if there is none
+func openStore(cCtx *cli.Context) (*store.Store, error) {
+	opt, err := redisConnOpt(cCtx)
+	if err != nil {
+		return nil, err
+	}
+	return store.New(opt)
+}
+
+// wrapperArg returns the wrapper address given on the command line
+func wrapperArg(cCtx *cli.Context) (string, error) {
+	addr := cCtx.Args().First()
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("expected a wrapper address like 127.0.0.1:10020: %w", err)
+	}
+	return addr, nil
+}
+
+func listWrappers(cCtx *cli.Context) error {
+	st, err := openStore(cCtx)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	pool, err := st.Wrappers(cCtx.Context)
+	if err != nil {
+		return err
+	}
+	draining, err := st.DrainingWrappers(cCtx.Context)
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]string, 0, len(pool))
+	for addr := range pool {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ADDRESS\tSLOTS\tWEIGHT\tLABELS\tLEASED\tSTATE")
+	for _, addr := range addrs {
+		leases, err := st.WrapperLeases(cCtx.Context, addr)
+		if err != nil {
+			return err
+		}
+		health, err := st.WrapperHealth(cCtx.Context, addr)
+		if err != nil {
+			return err
+		}
+
+		state := "active"
+		switch {
+		case slices.Contains(draining, addr):
+			state = "draining"
+		case health != nil && health.Quarantined:
+			state = "quarantined"
+		}
+		labels := strings.Join(pool[addr].Labels, ",")
+		if labels == "" {
+			labels = "-"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%s\n", addr, pool[addr].Slots, pool[addr].Weight, labels, len(leases), state)
+	}
+	return w.Flush()
+}
+
+func addWrapper(cCtx *cli.Context) error {
+	addr, err := wrapperArg(cCtx)
+	if err != nil {
+		return err
+	}
+	if cCtx.Int("slots") < 1 {
+		return errors.New("a wrapper needs at least one slot")
+	}
+	if cCtx.Int("weight") < 1 {
+		return errors.New("the weight of a wrapper needs to be at least 1")
+	}
+	labels := cCtx.StringSlice("label")
+	for _, label := range labels {
+		if _, ok := ripper.Priorities[label]; !ok {
+			return fmt.Errorf("unknown label %q, labels are priorities", label)
+		}
+	}
+
+	st, err := openStore(cCtx)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	return st.AddWrapper(cCtx.Context, addr, store.Wrapper{Slots: cCtx.Int("slots"), Weight: cCtx.Int("weight"), Labels: labels})
+}
+
+func drainWrapper(cCtx *cli.Context) error {
+	addr, err := wrapperArg(cCtx)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(cCtx)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ok, err := st.DrainWrapper(cCtx.Context, addr)
+	if err == nil && !ok {
+		err = fmt.Errorf("wrapper %s is not in the pool", addr)
+	}
+	return err
+}
+
+func removeWrapper(cCtx *cli.Context) error {
+	addr, err := wrapperArg(cCtx)
+	if err != nil {
+		return err
+	}
+
+	st, err := openStore(cCtx)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	ok, err := st.RemoveWrapper(cCtx.Context, addr)
+	if err == nil && !ok {
+		err = fmt.Errorf("wrapper %s is not in the pool", addr)
+	}
+	return err
+}
+
+var wrapperCommand = &cli.Command{
+	Name:  "wrapper",
+	Usage: "Manage the wrapper pool of running instances",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "list",
+			Usage:  "List the wrappers in the pool",
+			Action: listWrappers,
+		},
+		{
+			Name:      "add",
+			Usage:     "Add a wrapper to the pool, or change its settings",
+			ArgsUsage: "<address:port>",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "slots",
+					Usage: "Number of rips the wrapper serves at once",
+					Value: 1,
+				},
+				&cli.IntFlag{
+					Name:  "weight",
+					Usage: "Preference for the wrapper over less weighted ones with the same load",
+					Value: 1,
+				},
+				&cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "Priority the wrapper is reserved for, may be repeated",
+				},
+			},
+			Action: addWrapper,
+		},
+		{
+			Name:      "drain",
+			Usage:     "Let a wrapper finish its rips without giving it new ones",
+			ArgsUsage: "<address:port>",
+			Action:    drainWrapper,
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove a wrapper from the pool, running rips are not interrupted",
+			ArgsUsage: "<address:port>",
+			Action:    removeWrapper,
+		},
+	},
+}
@@ -0,0 +1,36 @@
+package queue
+
+import "github.com/hibiken/asynq"
+
+// Backends selectable in the config
+const (
+	BackendRedis    = "redis"
+	BackendEmbedded = "embedded"
+)
+
+// Backend is the Redis the queues and the store keep their data in, either an external one or the embedded
+// emulation. It is not an abstraction over the queues: clients, inspectors, workers and the store all talk
+// Redis to it through asynq's connection options
+type Backend interface {
+	// ConnOpt returns the connection options of the backend
+	ConnOpt() asynq.RedisConnOpt
+	// Close releases the backend once nothing uses it anymore
+	Close() error
+}
+
+type redisBackend struct {
+	opt asynq.RedisConnOpt
+}
+
+// Redis is the backend of an external Redis, Sentinel or Cluster
+func Redis(opt asynq.RedisConnOpt) Backend {
+	return &redisBackend{opt: opt}
+}
+
+func (b *redisBackend) ConnOpt() asynq.RedisConnOpt {
+	return b.opt
+}
+
+func (b *redisBackend) Close() error {
+	return nil
+}
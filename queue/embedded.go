@@ -0,0 +1,352 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// snapshotInterval is how often the embedded backend writes its data to disk
+	snapshotInterval = 10 * time.Second
+	// clockInterval is how often the TTLs of the embedded backend are advanced
+	clockInterval = time.Second
+	// snapshotVersion is bumped when the snapshot format changes
+	snapshotVersion = 2
+)
+
+// Embedded runs miniredis, an in-memory Redis emulation made for tests, on a loopback port of the process,
+// so ripper-api can be tried out without Redis. It is not a production backend: the data is only written to
+// a file every snapshotInterval and on Close, so a crash loses the submissions, leases and job updates since
+// the last snapshot, and every snapshot copies the whole keyspace
+type Embedded struct {
+	path     string
+	password string
+	srv      *miniredis.Miniredis
+	client   *redis.Client
+	logger   zerolog.Logger
+
+	// mu keeps snapshots from overlapping
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// snapshotKey is a key of the embedded backend with its value. Values are kept as bytes, since asynq stores binary
+// task messages: the string; hash fields and values in turn; list items; set members; or zset members and scores in turn
+type snapshotKey struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// ExpiresAt is the expiry in Unix milliseconds, 0 if the key doesn't expire
+	ExpiresAt int64         `json:"expiresAt,omitempty"`
+	Values    [][]byte      `json:"values,omitempty"`
+	Stream    []streamEntry `json:"stream,omitempty"`
+}
+
+type streamEntry struct {
+	Id     string   `json:"id"`
+	Values [][]byte `json:"values"`
+}
+
+type snapshot struct {
+	Version int           `json:"version"`
+	SavedAt time.Time     `json:"savedAt"`
+	Keys    []snapshotKey `json:"keys"`
+}
+
+// dumpScript reads every key with its type, remaining TTL in milliseconds and value. Scripts run atomically,
+// so the snapshot is of a single point in time and a task moving between lists is never caught halfway
+var dumpScript = redis.NewScript(`
+local out = {}
+for _, key in ipairs(redis.call('KEYS', '*')) do
+	local kind = redis.call('TYPE', key)['ok']
+	local value = {}
+	if kind == 'string' then
+		value = {redis.call('GET', key)}
+	elseif kind == 'hash' then
+		value = redis.call('HGETALL', key)
+	elseif kind == 'list' then
+		value = redis.call('LRANGE', key, 0, -1)
+	elseif kind == 'set' then
+		value = redis.call('SMEMBERS', key)
+	elseif kind == 'zset' then
+		value = redis.call('ZRANGE', key, 0, -1, 'WITHSCORES')
+	elseif kind == 'stream' then
+		value = redis.call('XRANGE', key, '-', '+')
+	end
+	table.insert(out, {key, kind, redis.call('PTTL', key), value})
+end
+return out
+`)
+
+// OpenEmbedded starts the embedded backend on a local port, with the data of the snapshot at path if there is one
+func OpenEmbedded(path string, logger zerolog.Logger) (*Embedded, error) {
+	if path == "" {
+		return nil, errors.New("the embedded backend needs a data file")
+	}
+
+	// the port is only reachable locally, the password keeps other local users out
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	e := &Embedded{
+		path:     path,
+		password: hex.EncodeToString(secret),
+		srv:      miniredis.NewMiniRedis(),
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	e.srv.RequireAuth(e.password)
+
+	loaded, err := e.restore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	if err := e.srv.StartAddr("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	e.client = redis.NewClient(&redis.Options{Addr: e.srv.Addr(), Password: e.password})
+	logger.Info().Str("file", path).Int("keys", loaded).Msg("Embedded backend started")
+	logger.Warn().Dur("snapshotInterval", snapshotInterval).Msg("The embedded backend is for trying ripper-api out, a crash loses the changes since the last snapshot. Use Redis in production")
+
+	go e.run()
+	return e, nil
+}
+
+func (e *Embedded) ConnOpt() asynq.RedisConnOpt {
+	return asynq.RedisClientOpt{
+		Addr:     e.srv.Addr(),
+		Password: e.password,
+	}
+}
+
+// Close writes a last snapshot and stops the server
+func (e *Embedded) Close() error {
+	close(e.stop)
+	<-e.done
+
+	err := e.Snapshot()
+	_ = e.client.Close()
+	e.srv.Close()
+	return err
+}
+
+// run advances the TTLs, which the server doesn't do on its own, and takes the periodic snapshots
+func (e *Embedded) run() {
+	defer close(e.done)
+
+	clock := time.NewTicker(clockInterval)
+	defer clock.Stop()
+	snapshots := time.NewTicker(snapshotInterval)
+	defer snapshots.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case now := <-clock.C:
+			e.srv.FastForward(now.Sub(last))
+			last = now
+		case <-snapshots.C:
+			if err := e.Snapshot(); err != nil {
+				e.logger.Error().Err(err).Msg("Error writing snapshot of the embedded backend")
+			}
+		}
+	}
+}
+
+// Snapshot writes all keys to the data file, replacing the previous snapshot only once it's complete
+func (e *Embedded) Snapshot() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	reply, err := dumpScript.Run(context.Background(), e.client, nil).Slice()
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{Version: snapshotVersion, SavedAt: now.UTC()}
+	for _, item := range reply {
+		entry, err := e.dump(item)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		snap.Keys = append(snap.Keys, *entry)
+	}
+
+	tmp := e.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(&snap)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// dump turns a key of the dump script into a snapshot entry, keys of types nothing here uses are skipped
+func (e *Embedded) dump(item interface{}) (*snapshotKey, error) {
+	fields, ok := item.([]interface{})
+	if !ok || len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected dump entry %v", item)
+	}
+	key, _ := fields[0].(string)
+	entry := &snapshotKey{Key: key}
+	entry.Type, _ = fields[1].(string)
+	if ttl, _ := fields[2].(int64); ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Millisecond).UnixMilli()
+	}
+	value, _ := fields[3].([]interface{})
+
+	switch entry.Type {
+	case "string", "hash", "list", "set", "zset":
+		entry.Values = make([][]byte, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value in key %s", key)
+			}
+			entry.Values = append(entry.Values, []byte(s))
+		}
+	case "stream":
+		for _, v := range value {
+			se, ok := v.([]interface{})
+			if !ok || len(se) != 2 {
+				return nil, fmt.Errorf("unexpected stream entry in key %s", key)
+			}
+			id, _ := se[0].(string)
+			values, _ := se[1].([]interface{})
+			streamValue := streamEntry{Id: id, Values: make([][]byte, 0, len(values))}
+			for _, sv := range values {
+				s, _ := sv.(string)
+				streamValue.Values = append(streamValue.Values, []byte(s))
+			}
+			entry.Stream = append(entry.Stream, streamValue)
+		}
+	default:
+		e.logger.Warn().Str("key", key).Str("type", entry.Type).Msg("Key of unsupported type not saved")
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// restore loads the snapshot into the server, returns the number of keys loaded
+func (e *Embedded) restore() (int, error) {
+	f, err := os.Open(e.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var snap snapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("unknown snapshot version %d", snap.Version)
+	}
+
+	now := time.Now()
+	loaded := 0
+	for _, entry := range snap.Keys {
+		var ttl time.Duration
+		if entry.ExpiresAt > 0 {
+			ttl = time.UnixMilli(entry.ExpiresAt).Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+		}
+
+		if err := e.load(&entry); err != nil {
+			return loaded, fmt.Errorf("key %s: %w", entry.Key, err)
+		}
+		if ttl > 0 {
+			e.srv.SetTTL(entry.Key, ttl)
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+func (e *Embedded) load(entry *snapshotKey) error {
+	values := make([]string, len(entry.Values))
+	for i, v := range entry.Values {
+		values[i] = string(v)
+	}
+	if (entry.Type == "hash" || entry.Type == "zset") && len(values)%2 != 0 {
+		return fmt.Errorf("odd number of values for a %s", entry.Type)
+	}
+
+	var err error
+	switch entry.Type {
+	case "string":
+		if len(values) != 1 {
+			return errors.New("string without a value")
+		}
+		err = e.srv.Set(entry.Key, values[0])
+	case "hash":
+		for i := 0; i < len(values); i += 2 {
+			e.srv.HSet(entry.Key, values[i], values[i+1])
+		}
+	case "list":
+		_, err = e.srv.Push(entry.Key, values...)
+	case "set":
+		_, err = e.srv.SetAdd(entry.Key, values...)
+	case "zset":
+		for i := 0; i < len(values) && err == nil; i += 2 {
+			var score float64
+			if score, err = strconv.ParseFloat(values[i+1], 64); err == nil {
+				_, err = e.srv.ZAdd(entry.Key, score, values[i])
+			}
+		}
+	case "stream":
+		for _, se := range entry.Stream {
+			fields := make([]string, len(se.Values))
+			for i, v := range se.Values {
+				fields[i] = string(v)
+			}
+			if _, err = e.srv.XAdd(entry.Key, se.Id, fields); err != nil {
+				break
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported type %q", entry.Type)
+	}
+	return err
+}
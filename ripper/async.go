@@ -2,38 +2,91 @@ package ripper
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"ripper-api/store"
 
 	"github.com/hibiken/asynq"
+	"github.com/rs/zerolog"
 )
 
 const (
-	TypeRip    = "download:apple"
-	TypeInit   = "init:queue"
-	TypeDelete = "remove:task"
+	TypeRip  = "download:apple"
+	TypeInit = "init:queue"
 )
 
 type RipPayload struct {
 	AlbumId    string
-	Token      string
 	Storefront string
-	Wrapper    string
 	WebDir     string
+	Options    RipOptions
+	// Retention is how long the job can be queried once it's done, its result is held for that long
+	Retention time.Duration
+	// ResultTTL is how long the result is kept after its last download, 0 keeps it until it gets evicted
+	ResultTTL time.Duration
+	// SubmittedAt tells the runs of a job apart in its history
+	SubmittedAt time.Time
 }
 
-type DeletePayload struct {
-	FolderPath string
+// RipOptions are the per-job settings that change what ends up in the result
+type RipOptions struct {
+	// Language of the metadata, e.g. "en-US"
+	Language string `json:",omitempty"`
+	// MetaStorefront is the storefront metadata is taken from, the album is still ripped from the payload storefront
+	MetaStorefront string `json:",omitempty"`
+	// Tracks limits the rip to these tracks, see Selects. Empty means the whole album
+	Tracks []string `json:",omitempty"`
 }
 
-func NewRipTask(storefront string, albumId string, webdir string, wrapper string) (*asynq.Task, error) {
-	token, err := getToken()
-	if err != nil {
-		return nil, err
+// Selects reports whether the track is part of the selection. A selection entry is either "#" and
+// the position of the track in the album (1-based across discs), "disc:track", or the song ID
+func (o RipOptions) Selects(position int, disc int, trackNumber int, id string) bool {
+	if len(o.Tracks) == 0 {
+		return true
 	}
+	for _, sel := range o.Tracks {
+		if sel == id || sel == "#"+strconv.Itoa(position) || sel == fmt.Sprintf("%d:%d", disc, trackNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+type TaskHandler struct {
+	Store     *store.Store
+	Client    *asynq.Client
+	Inspector *asynq.Inspector
+	WebDir    string
+	// CacheBudget is the disk space in bytes results may take up, 0 means no limit
+	CacheBudget int64
+	// OrphanTTL is how long a folder that no job or cache entry refers to is kept around
+	OrphanTTL time.Duration
+	// ProbeTimeout bounds a single wrapper probe
+	ProbeTimeout time.Duration
+	// QuarantineAfter is the number of failed probes in a row that quarantine a wrapper
+	QuarantineAfter int
+}
+
+// ResultKey derives a stable key from everything that affects the rip result.
+// It names the result folder, the cache entry and the rip job itself,
+// so the same album submitted twice ends up as a single job
+func ResultKey(storefront string, albumId string, opts RipOptions) string {
+	// marshalling a struct keeps the field order stable
+	options, _ := json.Marshal(opts)
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%s:%s", storefront, albumId, options)))
+	return hex.EncodeToString(sum[:])
+}
 
-	payload, err := json.Marshal(RipPayload{AlbumId: albumId, Token: token, Storefront: storefront, Wrapper: wrapper, WebDir: webdir})
+func NewRipTask(storefront string, albumId string, webdir string, opts RipOptions, retention time.Duration, resultTTL time.Duration, submittedAt time.Time) (*asynq.Task, error) {
+	payload, err := json.Marshal(RipPayload{AlbumId: albumId, Storefront: storefront, WebDir: webdir, Options: opts, Retention: retention, ResultTTL: resultTTL, SubmittedAt: submittedAt})
 
 	if err != nil {
 		return nil, err
@@ -48,34 +101,160 @@ func NewInitQueueTask() (*asynq.Task, error) {
 	return asynq.NewTask(TypeInit, payload), nil
 }
 
-func NewDeleteTask(dir string) (*asynq.Task, error) {
-	payload, err := json.Marshal(DeletePayload{FolderPath: dir})
+func (h *TaskHandler) HandleProcessTask(ctx context.Context, t *asynq.Task) (err error) {
+	var p RipPayload
+
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	key := ResultKey(p.Storefront, p.AlbumId, p.Options)
+	jobId, _ := asynq.GetTaskID(ctx)
+	queue, _ := asynq.GetQueueName(ctx)
+
+	// everything logged during the rip carries the job it belongs to
+	logger := zerolog.Ctx(ctx).With().
+		Str("job", jobId).
+		Str("queue", queue).
+		Str("album", p.AlbumId).
+		Str("storefront", p.Storefront).
+		Logger()
+	ctx = logger.WithContext(ctx)
+	logger.Info().Msg("rip started")
+
+	var result *RipResult
+	if err := h.Store.JobStarted(ctx, jobId, p.SubmittedAt, JobRunning); err != nil {
+		logger.Warn().Err(err).Msg("failed to record job history")
+	}
+	defer func() {
+		h.recordOutcome(ctx, jobId, p.SubmittedAt, result, err)
+	}()
+
+	// hold the result while ripping, so it can't be evicted halfway through, and for the retention of the job
+	// once it's done, so the job can still be downloaded. Failed rips have nothing to download
+	deadline, _ := ctx.Deadline()
+	if err := h.Store.HoldResult(ctx, key, jobId, deadline); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = h.Store.ReleaseResult(context.Background(), key, jobId)
+		}
+	}()
 
+	token, err := GetToken(ctx, h.Store)
 	if err != nil {
-		return nil, err
+		logger.Error().Err(err).Msg("failed to get token")
+		return err
+	}
+	meta, err := GetMeta(ctx, p.AlbumId, token, p.Storefront, p.Options.Language)
+	if FailureKind(err) == KindAuth {
+		// Apple may revoke a token before it expires
+		logger.Info().Msg("token rejected, retrying with a fresh one")
+		if token, err = RefreshToken(ctx, h.Store, token); err == nil {
+			meta, err = GetMeta(ctx, p.AlbumId, token, p.Storefront, p.Options.Language)
+		}
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("kind", FailureKind(err)).Msg("failed to get album metadata")
+		return withRetryPolicy(err)
 	}
 
-	return asynq.NewTask(TypeDelete, payload), nil
-}
+	if p.Options.MetaStorefront != "" && p.Options.MetaStorefront != p.Storefront {
+		// the album may not be available there, in which case the rip storefront metadata stays
+		localized, err := GetMeta(ctx, p.AlbumId, token, p.Options.MetaStorefront, p.Options.Language)
+		if err == nil {
+			Localize(meta, localized)
+		} else {
+			logger.Warn().Err(err).Str("metadataStorefront", p.Options.MetaStorefront).Msg("failed to get localized metadata")
+		}
+	}
 
-func HandleProcessTask(_ context.Context, t *asynq.Task) error {
-	var p RipPayload
+	selected := 0
+	for i, track := range meta.Data[0].Relationships.Tracks.Data {
+		if p.Options.Selects(i+1, track.Attributes.DiscNumber, track.Attributes.TrackNumber, track.ID) {
+			selected++
+		}
+	}
+	if selected == 0 {
+		return fmt.Errorf("none of the tracks %v are on the album: %w", p.Options.Tracks, asynq.SkipRetry)
+	}
 
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	folder := AlbumFolder(meta, filepath.Join(p.WebDir, key))
+
+	if err := PrepareAlbum(ctx, meta, folder); err != nil {
+		return err
+	}
+
+	// the tracks are ripped by their own tasks, spread over all wrappers
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := h.Store.SetAlbumMeta(ctx, key, raw, time.Until(deadline)+time.Hour); err != nil {
+		return err
+	}
+	defer func() {
+		_ = h.Store.DropAlbumMeta(context.Background(), key)
+	}()
+
+	failed, err := h.ripTracks(ctx, &p, key, folder, meta)
+	if err != nil {
+		logger.Error().Err(err).Msg("rip failed")
+		return err
+	}
+	for position, reason := range failed {
+		logger.Warn().
+			Int("track", position).
+			Str("song", meta.Data[0].Relationships.Tracks.Data[position-1].ID).
+			Str("error", reason).
+			Msg("track failed for good")
 	}
 
-	folder, err := Rip(p.AlbumId, p.Token, p.Storefront, p.Wrapper, p.WebDir)
+	result = h.ripResult(ctx, jobId, &p, folder, meta, failed)
+	_ = h.Store.DropTrackReports(context.Background(), jobId)
+	raw, err = json.Marshal(result)
 	if err != nil {
 		return err
 	}
+	// the report is kept even if the job fails
+	if _, err := t.ResultWriter().Write(raw); err != nil {
+		return err
+	}
+
+	if len(failed) == selected {
+		return fmt.Errorf("all %d tracks failed: %w", selected, asynq.SkipRetry)
+	}
 
-	res := []byte(folder)
+	size, err := dirSize(folder)
+	if err != nil {
+		return err
+	}
+	if err := h.Store.HoldResult(ctx, key, jobId, time.Now().Add(p.Retention)); err != nil {
+		return err
+	}
 
-	_, err = t.ResultWriter().Write(res)
+	total, err := h.Store.CachePut(ctx, &store.CacheEntry{
+		Key:          key,
+		Folder:       folder,
+		Size:         size,
+		AlbumId:      p.AlbumId,
+		Storefront:   p.Storefront,
+		Partial:      result.Partial,
+		FailureKinds: result.FailureKinds(),
+		TTL:          p.ResultTTL,
+	})
 	if err != nil {
 		return err
 	}
+
+	if h.CacheBudget > 0 && total > h.CacheBudget {
+		if err := h.evict(ctx, total-h.CacheBudget); err != nil {
+			return err
+		}
+	}
+
+	logger.Info().Int64("bytes", size).Int("failed", len(failed)).Msg("rip finished")
 	return nil
 }
 
@@ -83,16 +262,97 @@ func HandleInitQueueTask(_ context.Context, _ *asynq.Task) error {
 	return nil
 }
 
-func HandleDeleteTask(_ context.Context, t *asynq.Task) error {
-	var p DeletePayload
+// evict removes least recently used results until at least excess bytes are freed
+func (h *TaskHandler) evict(ctx context.Context, excess int64) error {
+	const batch = 16
 
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	var skipped int64
+	for excess > 0 {
+		entries, err := h.Store.CacheOldest(ctx, skipped+batch)
+		if err != nil {
+			return err
+		}
+		entries = entries[min(int(skipped), len(entries)):]
+		if len(entries) == 0 {
+			return nil
+		}
+
+		for _, entry := range entries {
+			if excess <= 0 {
+				return nil
+			}
+			dropped, err := h.removeEntry(ctx, entry)
+			if err != nil {
+				return err
+			}
+			if !dropped {
+				skipped++
+				continue
+			}
+			excess -= entry.Size
+		}
+	}
+	return nil
+}
+
+// removeEntry drops the entry from the cache and deletes its files, unless a job holds it
+func (h *TaskHandler) removeEntry(ctx context.Context, entry *store.CacheEntry) (bool, error) {
+	dropped, err := h.Store.CacheDrop(ctx, entry)
+	if err != nil || !dropped {
+		return false, err
 	}
 
-	err := os.RemoveAll(p.FolderPath)
+	// move the result out of the way first, a new rip of the same album may start right away
+	root := filepath.Dir(entry.Folder)
+	trash := fmt.Sprintf("%s.evicted-%d", root, time.Now().UnixNano())
+	if err := os.Rename(root, trash); err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return true, err
+	}
+	return true, os.RemoveAll(trash)
+}
+
+// SyncCache drops cache entries whose files disappeared from disk
+func (h *TaskHandler) SyncCache(ctx context.Context) error {
+	keys, err := h.Store.CacheKeys(ctx)
 	if err != nil {
 		return err
 	}
+
+	for _, key := range keys {
+		entry, err := h.Store.CacheGet(ctx, key)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		if _, err := os.Stat(entry.Folder); os.IsNotExist(err) {
+			if _, err := h.Store.CacheDrop(ctx, entry); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
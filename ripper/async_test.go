@@ -0,0 +1,38 @@
+package ripper
+
+import "testing"
+
+func TestSelects(t *testing.T) {
+	// the twelfth track of the album, second on its second disc
+	const (
+		position = 12
+		disc     = 2
+		track    = 2
+		id       = "1440833098"
+	)
+
+	tests := []struct {
+		name   string
+		tracks []string
+		want   bool
+	}{
+		{name: "whole album", tracks: nil, want: true},
+		{name: "position", tracks: []string{"#12"}, want: true},
+		{name: "other position", tracks: []string{"#2"}, want: false},
+		{name: "bare number is a song ID", tracks: []string{"12"}, want: false},
+		{name: "disc and track", tracks: []string{"2:2"}, want: true},
+		{name: "track on other disc", tracks: []string{"1:2"}, want: false},
+		{name: "song ID", tracks: []string{id}, want: true},
+		{name: "other song ID", tracks: []string{"1440833099"}, want: false},
+		{name: "any entry", tracks: []string{"#1", "1:5", id}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := RipOptions{Tracks: tt.tracks}
+			if got := opts.Selects(position, disc, track, id); got != tt.want {
+				t.Errorf("Selects with %v = %v, want %v", tt.tracks, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package ripper
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/rs/zerolog"
+)
+
+const (
+	TypeCollect = "collect:orphans"
+	// stalePart is the age after which a partially written file is left over from a crash,
+	// tracks are written in one go once they are decrypted
+	stalePart = 10 * time.Minute
+	// MaintenanceQueue runs housekeeping tasks, away from the wrapper queues
+	MaintenanceQueue = "maintenance"
+)
+
+func NewCollectTask() (*asynq.Task, error) {
+	var payload []byte
+
+	return asynq.NewTask(TypeCollect, payload), nil
+}
+
+// HandleCollectTask removes cached results past their TTL, and folders in the web folder that are neither cached
+// nor used by a live job and haven't been modified for OrphanTTL
+func (h *TaskHandler) HandleCollectTask(ctx context.Context, _ *asynq.Task) error {
+	logger := zerolog.Ctx(ctx)
+
+	expired, err := h.Store.CacheExpired(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range expired {
+		removed, err := h.removeEntry(ctx, entry)
+		if err != nil {
+			return err
+		}
+		if removed {
+			logger.Info().
+				Str("folder", entry.Folder).
+				Int64("bytes", entry.Size).
+				Dur("ttl", entry.TTL).
+				Msg("Removed expired result")
+		}
+	}
+
+	entries, err := os.ReadDir(h.WebDir)
+	if err != nil {
+		return err
+	}
+
+	var folders int
+	var reclaimed int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		path := filepath.Join(h.WebDir, name)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// leftovers of an interrupted eviction are always garbage
+		if !strings.Contains(name, ".evicted-") {
+			if time.Since(info.ModTime()) < h.OrphanTTL {
+				continue
+			}
+			live, err := h.isLive(ctx, name)
+			if err != nil {
+				return err
+			}
+			if live {
+				continue
+			}
+		}
+
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+
+		logger.Info().
+			Str("folder", path).
+			Int64("bytes", size).
+			Time("modified", info.ModTime()).
+			Msg("Removed orphaned result")
+		folders++
+		reclaimed += size
+	}
+
+	if folders > 0 {
+		logger.Info().
+			Int("folders", folders).
+			Int64("bytes", reclaimed).
+			Msg("Orphaned results collected")
+	}
+	return h.CleanPartial(ctx)
+}
+
+// CleanPartial removes files that an interrupted rip left half written, so the rip can write them again.
+// Other workers may share the web folder, only files that haven't been written to for a while are removed
+func (h *TaskHandler) CleanPartial(ctx context.Context) error {
+	logger := zerolog.Ctx(ctx)
+
+	return filepath.WalkDir(h.WebDir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed by an eviction in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), partSuffix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < stalePart {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		logger.Info().
+			Str("file", path).
+			Time("modified", info.ModTime()).
+			Msg("Removed partially written file")
+		return nil
+	})
+}
+
+// isLive reports whether the result folder named key is cached or belongs to a job that hasn't finished
+func (h *TaskHandler) isLive(ctx context.Context, key string) (bool, error) {
+	cached, err := h.Store.IsCached(ctx, key)
+	if err != nil || cached {
+		return cached, err
+	}
+
+	held, err := h.Store.IsHeld(ctx, key)
+	if err != nil || held {
+		return held, err
+	}
+
+	queue, err := h.Store.ClaimedQueue(ctx, key)
+	if err != nil || queue == "" {
+		return false, err
+	}
+
+	info, err := h.Inspector.GetTaskInfo(queue, key)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.State != asynq.TaskStateArchived && info.State != asynq.TaskStateCompleted, nil
+}
@@ -0,0 +1,116 @@
+package ripper
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Kinds of failures, they decide whether and when a failed task is retried
+const (
+	// KindTransient failures are network errors, 429 and 5xx answers, retried with backoff
+	KindTransient = "transient"
+	// KindWrapper failures lost the wrapper connection, retried soon since the next attempt avoids that wrapper
+	KindWrapper = "wrapper"
+	// KindAuth failures were rejected tokens, tried again right away with a fresh token, then retried like transient ones
+	KindAuth = "auth"
+	// KindPermanent failures are 4xx answers, missing songs and tracks without a lossless stream, never retried
+	KindPermanent = "permanent"
+	// KindMalformed failures are streams that can't be parsed, never retried
+	KindMalformed = "malformed"
+)
+
+const (
+	// retryBase is the delay before the first retry of a transient failure, it doubles with every retry
+	retryBase = 5 * time.Second
+	retryMax  = 10 * time.Minute
+	// wrapperRetry is the delay before retrying a wrapper failure
+	wrapperRetry = 2 * time.Second
+)
+
+// HTTPError is an unexpected answer from Apple's servers
+type HTTPError struct {
+	Status     string
+	StatusCode int
+	// RetryAfter is the delay a 429 or 503 answer asked for, if any
+	RetryAfter time.Duration
+}
+
+func newHTTPError(resp *http.Response) *HTTPError {
+	err := &HTTPError{Status: resp.Status, StatusCode: resp.StatusCode}
+	if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+func (e *HTTPError) Error() string {
+	return e.Status
+}
+
+// FailureKind returns the kind of the failure, see the Kind constants
+func FailureKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNoLossless), errors.Is(err, ErrSongMissing):
+		return KindPermanent
+	case errors.Is(err, ErrUnknownKeys), errors.Is(err, ErrNotMaster), errors.Is(err, ErrNoAlac), errors.Is(err, ErrOffsetMismatch):
+		return KindMalformed
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusUnauthorized:
+			return KindAuth
+		case httpErr.StatusCode == http.StatusTooManyRequests, httpErr.StatusCode >= http.StatusInternalServerError:
+			return KindTransient
+		default:
+			return KindPermanent
+		}
+	}
+
+	var trackErr *TrackError
+	if errors.As(err, &trackErr) && trackErr.Class == ClassWrapper {
+		return KindWrapper
+	}
+	// unknown failures get retried, giving up on something that would have worked is worse
+	return KindTransient
+}
+
+// withRetryPolicy marks permanent and malformed failures so asynq doesn't retry them
+func withRetryPolicy(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch FailureKind(err) {
+	case KindPermanent, KindMalformed:
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// RetryDelay is the asynq RetryDelayFunc for rips: exponential backoff with jitter for transient failures,
+// at least as long as the server asked for, and a short fixed delay for wrapper failures
+func RetryDelay(n int, err error, _ *asynq.Task) time.Duration {
+	if FailureKind(err) == KindWrapper {
+		return wrapperRetry
+	}
+
+	delay := retryMax
+	if n < 10 {
+		delay = min(retryBase<<n, retryMax)
+	}
+	// up to 20% jitter, so tracks of an album failing together don't come back together
+	delay += time.Duration(rand.Int64N(int64(delay) / 5))
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > delay {
+		delay = httpErr.RetryAfter
+	}
+	return delay
+}
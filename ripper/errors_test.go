@@ -0,0 +1,52 @@
+package ripper
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	transient := errors.New("connection reset")
+	wrapper := &TrackError{Class: ClassWrapper, Err: errors.New("wrapper closed the connection")}
+
+	tests := []struct {
+		name string
+		n    int
+		err  error
+		// the delay is expected in [min, max), jitter adds up to 20%
+		min, max time.Duration
+	}{
+		{name: "first retry", n: 0, err: transient, min: 5 * time.Second, max: 6 * time.Second},
+		{name: "doubles", n: 3, err: transient, min: 40 * time.Second, max: 48 * time.Second},
+		{name: "capped", n: 7, err: transient, min: 10 * time.Minute, max: 12 * time.Minute},
+		{name: "capped without overflow", n: 80, err: transient, min: 10 * time.Minute, max: 12 * time.Minute},
+		{name: "wrapper", n: 5, err: wrapper, min: 2 * time.Second, max: 2*time.Second + 1},
+		{
+			name: "retry after longer than backoff",
+			n:    0,
+			err:  &HTTPError{StatusCode: 429, RetryAfter: 30 * time.Minute},
+			min:  30 * time.Minute,
+			max:  30*time.Minute + 1,
+		},
+		{
+			name: "retry after shorter than backoff",
+			n:    2,
+			err:  &HTTPError{StatusCode: 503, RetryAfter: time.Second},
+			min:  20 * time.Second,
+			max:  24 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// jitter is random, a few rounds make a wrong range more likely to show
+			for range 20 {
+				got := RetryDelay(tt.n, tt.err, nil)
+				if got < tt.min || got >= tt.max {
+					t.Fatalf("RetryDelay(%d, %v) = %v, want in [%v, %v)", tt.n, tt.err, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package ripper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"ripper-api/store"
+
+	"github.com/hibiken/asynq"
+	"github.com/rs/zerolog"
+)
+
+const TypeProbe = "probe:wrappers"
+
+func NewProbeTask() (*asynq.Task, error) {
+	var payload []byte
+
+	return asynq.NewTask(TypeProbe, payload), nil
+}
+
+// probeWrapper connects to the wrapper and, if it's idle, opens a session with an empty song ID.
+// The wrapper treats that as the end of the session and closes the connection, anything else means it's stuck
+func probeWrapper(ctx context.Context, addr string, idle bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	// a busy wrapper only serves one session at a time, the connection alone has to do
+	if !idle {
+		return nil
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err == nil {
+		return errors.New("wrapper answered an empty session")
+	}
+	return err
+}
+
+// HandleProbeTask probes every pooled wrapper. Wrappers that fail QuarantineAfter probes in a row
+// are quarantined, and the rips running on them are cancelled so they are retried on another wrapper.
+// A quarantined wrapper is released by its next successful probe
+func (h *TaskHandler) HandleProbeTask(ctx context.Context, _ *asynq.Task) error {
+	logger := zerolog.Ctx(ctx)
+
+	pool, err := h.Store.Wrappers(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(pool))
+	for addr := range pool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- h.probe(ctx, logger.With().Str("wrapper", addr).Logger(), addr)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var all []error
+	for err := range errs {
+		all = append(all, err)
+	}
+	return errors.Join(all...)
+}
+
+func (h *TaskHandler) probe(ctx context.Context, logger zerolog.Logger, addr string) error {
+	leases, err := h.Store.WrapperLeases(ctx, addr)
+	if err != nil {
+		return err
+	}
+	health, err := h.Store.WrapperHealth(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if health == nil {
+		health = new(store.WrapperHealth)
+	}
+
+	probeErr := probeWrapper(ctx, addr, len(leases) == 0, h.ProbeTimeout)
+	health.CheckedAt = time.Now().UTC()
+
+	if probeErr == nil {
+		if health.Quarantined {
+			logger.Info().Msg("wrapper recovered, leaving quarantine")
+		}
+		health.Failures, health.Error, health.Quarantined = 0, "", false
+		return h.Store.SetWrapperHealth(ctx, addr, health)
+	}
+
+	health.Failures++
+	health.Error = probeErr.Error()
+	logger.Warn().Err(probeErr).Int("failures", health.Failures).Msg("wrapper probe failed")
+
+	quarantine := !health.Quarantined && health.Failures >= h.QuarantineAfter
+	if quarantine {
+		health.Quarantined = true
+	}
+	if err := h.Store.SetWrapperHealth(ctx, addr, health); err != nil {
+		return err
+	}
+	if !quarantine {
+		return nil
+	}
+
+	logger.Error().Int("rips", len(leases)).Msg("wrapper quarantined")
+	for _, jobId := range leases {
+		// the rip gives up its lease and goes back to the queue as a retry
+		if err := h.Inspector.CancelProcessing(jobId); err != nil {
+			logger.Warn().Err(err).Str("job", jobId).Msg("failed to cancel rip")
+		}
+	}
+	return nil
+}
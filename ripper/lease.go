@@ -0,0 +1,75 @@
+package ripper
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// leaseTTL is how long a slot stays leased without being renewed, e.g. after a worker crashed
+	leaseTTL = time.Minute
+	// leaseRetry is how often a job waiting for a free wrapper asks again
+	leaseRetry = time.Second
+	// failedWrapperTTL is how long a job avoids a wrapper it lost
+	failedWrapperTTL = time.Hour
+)
+
+// leaseWrapper waits until a wrapper serving label has a free slot and leases it to the job.
+// A wrapper the job lost before is avoided if there are others. The lease is renewed in the background
+// until release is called
+func (h *TaskHandler) leaseWrapper(ctx context.Context, jobId string, label string) (string, func(), error) {
+	logger := zerolog.Ctx(ctx)
+
+	avoid, err := h.Store.FailedWrapper(ctx, jobId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var wrapper string
+	for waiting := false; ; waiting = true {
+		wrapper, err = h.Store.LeaseWrapper(ctx, jobId, label, avoid, leaseTTL)
+		if err != nil {
+			return "", nil, err
+		}
+		if wrapper != "" {
+			break
+		}
+		if !waiting {
+			logger.Info().Msg("waiting for a free wrapper")
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(leaseRetry):
+		}
+	}
+
+	renewCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				if err := h.Store.RenewLease(renewCtx, wrapper, jobId, leaseTTL); err != nil {
+					logger.Warn().Err(err).Str("wrapper", wrapper).Msg("failed to renew wrapper lease")
+				}
+			}
+		}
+	}()
+
+	release := func() {
+		stop()
+		<-done
+		if err := h.Store.ReleaseWrapper(context.Background(), wrapper, jobId); err != nil {
+			logger.Warn().Err(err).Str("wrapper", wrapper).Msg("failed to release wrapper")
+		}
+	}
+	return wrapper, release, nil
+}
@@ -0,0 +1,58 @@
+package ripper
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Priorities maps every priority to the weight of its queue
+var Priorities = map[string]int{
+	PriorityHigh:   6,
+	PriorityNormal: 3,
+	PriorityLow:    1,
+}
+
+// priorityOrder ranks the priorities from lowest to highest
+var priorityOrder = []string{PriorityLow, PriorityNormal, PriorityHigh}
+
+// Outranks reports whether priority a comes before priority b
+func Outranks(a string, b string) bool {
+	return slices.Index(priorityOrder, a) > slices.Index(priorityOrder, b)
+}
+
+// ripQueue is shared by all wrappers, workers pick a free wrapper once a rip starts
+const ripQueue = "rip"
+
+// QueueName returns the rip queue for the given priority
+func QueueName(priority string) string {
+	if priority == PriorityNormal || priority == "" {
+		return ripQueue
+	}
+	return ripQueue + ":" + priority
+}
+
+// trackQueue holds the tracks of album rips, one task per track
+const trackQueue = "tracks"
+
+// TrackQueueName returns the track queue for the given priority
+func TrackQueueName(priority string) string {
+	if priority == PriorityNormal || priority == "" {
+		return trackQueue
+	}
+	return trackQueue + ":" + priority
+}
+
+// PriorityOf returns the priority of a rip or track queue
+func PriorityOf(queue string) string {
+	_, priority, ok := strings.Cut(queue, ":")
+	if !ok {
+		return PriorityNormal
+	}
+	return priority
+}
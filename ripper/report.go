@@ -0,0 +1,138 @@
+package ripper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/rs/zerolog"
+)
+
+const (
+	TrackRipped = "ripped"
+	TrackFailed = "failed"
+)
+
+// Job statuses, as kept in the job history
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobRetrying  = "retrying"
+	JobFailed    = "failed"
+	JobCompleted = "completed"
+	JobPartial   = "partial"
+)
+
+// TrackReport is the outcome of a single track of a rip
+type TrackReport struct {
+	Position int    `json:"position"`
+	Id       string `json:"id"`
+	Title    string `json:"title"`
+	Status   string `json:"status"`
+	// Class is one of the Class constants, or "unknown" for failures outside of RipTrack
+	Class string `json:"errorClass,omitempty"`
+	// Kind is one of the Kind constants, it decided whether the track was retried
+	Kind  string `json:"errorKind,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// RipResult is what a finished rip writes as its task result
+type RipResult struct {
+	Folder string `json:"folder"`
+	// Partial is set when some of the selected tracks failed
+	Partial bool          `json:"partial"`
+	Tracks  []TrackReport `json:"tracks"`
+}
+
+// Failed returns the number of failed tracks
+func (r *RipResult) Failed() int {
+	var n int
+	for _, track := range r.Tracks {
+		if track.Status == TrackFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// FailureKinds returns the distinct kinds of failure of the failed tracks
+func (r *RipResult) FailureKinds() []string {
+	var kinds []string
+	for _, track := range r.Tracks {
+		if track.Status == TrackFailed && !slices.Contains(kinds, track.Kind) {
+			kinds = append(kinds, track.Kind)
+		}
+	}
+	return kinds
+}
+
+// Retryable reports whether ripping again could get tracks that failed with these kinds of failure
+func Retryable(kinds []string) bool {
+	for _, kind := range kinds {
+		if kind != KindPermanent && kind != KindMalformed {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRipResult reads the task result of a rip
+func ParseRipResult(raw []byte) (*RipResult, error) {
+	result := new(RipResult)
+	return result, json.Unmarshal(raw, result)
+}
+
+// ripResult reports every selected track, failed maps album positions to the last error of their task
+func (h *TaskHandler) ripResult(ctx context.Context, jobId string, p *RipPayload, folder string, meta *AutoGenerated, failed map[int]string) *RipResult {
+	result := &RipResult{Folder: folder, Partial: len(failed) > 0, Tracks: make([]TrackReport, 0)}
+	for i, track := range meta.Data[0].Relationships.Tracks.Data {
+		position := i + 1
+		if !p.Options.Selects(position, track.Attributes.DiscNumber, track.Attributes.TrackNumber, track.ID) {
+			continue
+		}
+
+		report := TrackReport{Position: position, Id: track.ID, Title: track.Attributes.Name, Status: TrackRipped}
+		if reason, ok := failed[position]; ok {
+			report.Status, report.Class, report.Error = TrackFailed, "unknown", reason
+			// the track task knows better what went wrong
+			if raw, err := h.Store.TrackReport(ctx, jobId, position); err == nil && raw != nil {
+				_ = json.Unmarshal(raw, &report)
+			}
+		}
+		result.Tracks = append(result.Tracks, report)
+	}
+	return result
+}
+
+// recordOutcome keeps the outcome of an attempt of the job in its history.
+// Failed attempts only finish the job when asynq won't retry them
+func (h *TaskHandler) recordOutcome(ctx context.Context, jobId string, run time.Time, result *RipResult, err error) {
+	ctx = context.WithoutCancel(ctx)
+
+	var raw []byte
+	if result != nil {
+		raw, _ = json.Marshal(result)
+	}
+
+	var recErr error
+	switch {
+	case err == nil && result != nil && result.Partial:
+		recErr = h.Store.JobFinished(ctx, jobId, run, JobPartial, "", raw)
+	case err == nil:
+		recErr = h.Store.JobFinished(ctx, jobId, run, JobCompleted, "", raw)
+	default:
+		retried, _ := asynq.GetRetryCount(ctx)
+		maxRetry, _ := asynq.GetMaxRetry(ctx)
+		if errors.Is(err, asynq.SkipRetry) || retried >= maxRetry {
+			recErr = h.Store.JobFinished(ctx, jobId, run, JobFailed, err.Error(), raw)
+		} else {
+			recErr = h.Store.JobFailed(ctx, jobId, run, JobRetrying, err.Error())
+		}
+	}
+	if recErr != nil {
+		zerolog.Ctx(ctx).Warn().Err(recErr).Msg("failed to record job history")
+	}
+}
@@ -2,6 +2,7 @@ package ripper
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -19,6 +20,7 @@ import (
 	"strings"
 
 	"github.com/grafov/m3u8"
+	"github.com/rs/zerolog"
 )
 
 func (s *SongInfo) Duration() (ret uint64) {
@@ -42,6 +44,34 @@ func fileExists(path string) (bool, error) {
 	return false, err
 }
 
+// partSuffix marks files that are still being written, they only get their name once they are complete
+const partSuffix = ".part"
+
+// createFile writes a file through write under a temporary name and renames it once it's complete,
+// so an interrupted rip never leaves a file behind that looks finished
+func createFile(filename string, write func(f *os.File) error) error {
+	part := filename + partSuffix
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(part, filename)
+	}
+	if err != nil {
+		_ = os.Remove(part)
+	}
+	return err
+}
+
 func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, trackNum, trackTotal int) error {
 	index := trackNum - 1
 	{ // ftyp
@@ -810,14 +840,20 @@ func writeM4a(w *mp4.Writer, info *SongInfo, meta *AutoGenerated, data []byte, t
 	return nil
 }
 
-func decryptSong(wrapper string, info *SongInfo, keys []string, manifest *AutoGenerated, filename string, trackNum, trackTotal int) error {
-	conn, err := net.Dial("tcp", wrapper)
+func decryptSong(ctx context.Context, wrapper string, info *SongInfo, keys []string, manifest *AutoGenerated, filename string, trackNum, trackTotal int) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", wrapper)
 	if err != nil {
 		return err
 	}
 	defer func(conn net.Conn) {
 		_ = conn.Close()
 	}(conn)
+	// a hung wrapper never answers, closing the connection unblocks the reads
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
 	var decrypted []byte
 	var lastIndex uint32 = math.MaxUint8
 
@@ -875,19 +911,13 @@ func decryptSong(wrapper string, info *SongInfo, keys []string, manifest *AutoGe
 	}
 	_, _ = conn.Write([]byte{0, 0, 0, 0, 0})
 
-	create, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer func(create *os.File) {
-		_ = create.Close()
-	}(create)
-
-	return writeM4a(mp4.NewWriter(create), info, manifest, decrypted, trackNum, trackTotal)
+	return createFile(filename, func(f *os.File) error {
+		return writeM4a(mp4.NewWriter(f), info, manifest, decrypted, trackNum, trackTotal)
+	})
 }
 
-func GetMeta(albumId string, token string, storefront string) (*AutoGenerated, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/albums/%s", storefront, albumId), nil)
+func GetMeta(ctx context.Context, albumId string, token string, storefront string, language string) (*AutoGenerated, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/catalog/%s/albums/%s", ApiUrl, storefront, albumId), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -901,7 +931,9 @@ func GetMeta(albumId string, token string, storefront string) (*AutoGenerated, e
 	query.Set("fields[artists]", "name")
 	query.Set("fields[albums:albums]", "artistName,artwork,name,releaseDate,url")
 	query.Set("fields[record-labels]", "name")
-	// query.Set("l", "en-gb")
+	if language != "" {
+		query.Set("l", language)
+	}
 	req.URL.RawQuery = query.Encode()
 	do, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -911,7 +943,7 @@ func GetMeta(albumId string, token string, storefront string) (*AutoGenerated, e
 		_ = Body.Close()
 	}(do.Body)
 	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+		return nil, newHTTPError(do)
 	}
 	obj := new(AutoGenerated)
 	err = json.NewDecoder(do.Body).Decode(&obj)
@@ -921,7 +953,7 @@ func GetMeta(albumId string, token string, storefront string) (*AutoGenerated, e
 	return obj, nil
 }
 
-func writeCover(sanAlbumFolder, url string) error {
+func writeCover(ctx context.Context, sanAlbumFolder, url string) error {
 	covPath := filepath.Join(sanAlbumFolder, "cover.jpg")
 	exists, err := fileExists(covPath)
 	if err != nil {
@@ -931,7 +963,7 @@ func writeCover(sanAlbumFolder, url string) error {
 		return nil
 	}
 	url = strings.Replace(url, "{w}x{h}", "12000x12000", 1)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -944,100 +976,164 @@ func writeCover(sanAlbumFolder, url string) error {
 		_ = Body.Close()
 	}(do.Body)
 	if do.StatusCode != http.StatusOK {
-		return errors.New(do.Status)
-	}
-	f, err := os.Create(covPath)
-	if err != nil {
-		return err
+		return newHTTPError(do)
 	}
-	defer func(f *os.File) {
-		_ = f.Close()
-	}(f)
-	_, err = io.Copy(f, do.Body)
-	if err != nil {
+	return createFile(covPath, func(f *os.File) error {
+		_, err := io.Copy(f, do.Body)
 		return err
-	}
-	return nil
+	})
 }
 
-func Rip(albumId string, token string, storefront string, wrapper string, dir string) (string, error) {
-	meta, err := GetMeta(albumId, token, storefront)
+// Localize replaces album and track metadata used for tags and folder names with the ones from
+// localized, which may come from another storefront or language. Tracks missing from localized keep their metadata
+func Localize(meta *AutoGenerated, localized *AutoGenerated) {
+	if len(meta.Data) == 0 || len(localized.Data) == 0 {
+		return
+	}
+	album := &meta.Data[0]
+	loc := localized.Data[0]
+
+	album.Attributes = loc.Attributes
+	album.Relationships.Artists = loc.Relationships.Artists
 
-	if err != nil {
-		return "", err
+	locTracks := make(map[string]int, len(loc.Relationships.Tracks.Data))
+	for i, track := range loc.Relationships.Tracks.Data {
+		locTracks[track.ID] = i
 	}
+	for i := range album.Relationships.Tracks.Data {
+		track := &album.Relationships.Tracks.Data[i]
+		if j, ok := locTracks[track.ID]; ok {
+			track.Attributes = loc.Relationships.Tracks.Data[j].Attributes
+		}
+	}
+}
 
+// AlbumFolder returns the folder inside dir that the album gets ripped into
+func AlbumFolder(meta *AutoGenerated, dir string) string {
 	albumFolder := fmt.Sprintf("%s - %s", meta.Data[0].Attributes.ArtistName, meta.Data[0].Attributes.Name)
-	sanAlbumFolder := filepath.Join(dir, ForbiddenNames.ReplaceAllString(albumFolder, ""))
+	return filepath.Join(dir, ForbiddenNames.ReplaceAllString(albumFolder, ""))
+}
+
+// ErrNoLossless is returned for tracks that have no ALAC stream, retrying them doesn't help
+var ErrNoLossless = errors.New("no lossless stream available")
+
+// ErrSongMissing is returned for tracks the catalog doesn't return, e.g. because they aren't available in the storefront
+var ErrSongMissing = errors.New("song not in the catalog")
+
+// ErrUnknownKeys is returned for streams whose samples reference keys the playlist doesn't list
+var ErrUnknownKeys = errors.New("samples reference unknown keys")
+
+// Errors of streams that don't look like they should
+var (
+	ErrNotMaster      = errors.New("m3u8 not of master type")
+	ErrNoAlac         = errors.New("no alac codec found")
+	ErrOffsetMismatch = errors.New("offset mismatch")
+)
+
+// Classes of track errors, named after the step the track failed at
+const (
+	ClassSongInfo    = "song_info"
+	ClassUnavailable = "unavailable"
+	ClassPlaylist    = "playlist"
+	ClassDownload    = "download"
+	ClassMalformed   = "malformed"
+	ClassWrapper     = "wrapper"
+)
+
+// TrackError is the reason a track couldn't be ripped
+type TrackError struct {
+	Class string
+	Err   error
+}
+
+func (e *TrackError) Error() string {
+	return e.Class + ": " + e.Err.Error()
+}
+
+func (e *TrackError) Unwrap() error {
+	return e.Err
+}
 
-	err = os.MkdirAll(sanAlbumFolder, os.ModePerm)
+// PrepareAlbum creates the album folder and writes the cover, the tracks are ripped separately by RipTrack
+func PrepareAlbum(ctx context.Context, meta *AutoGenerated, sanAlbumFolder string) error {
+	err := os.MkdirAll(sanAlbumFolder, os.ModePerm)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	_ = writeCover(sanAlbumFolder, meta.Data[0].Attributes.Artwork.URL)
-
-	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
+	if err := writeCover(ctx, sanAlbumFolder, meta.Data[0].Attributes.Artwork.URL); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to write cover")
+	}
+	return nil
+}
 
-	for trackNum, track := range meta.Data[0].Relationships.Tracks.Data {
-		trackNum++
-		manifest, err := getInfoFromAdam(track.ID, token, storefront)
-		if err != nil {
-			continue
-		}
-		if manifest.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
-			continue
-		}
+// TrackPath returns the file the track at the album position trackNum is ripped to
+func TrackPath(meta *AutoGenerated, sanAlbumFolder string, trackNum int) string {
+	track := meta.Data[0].Relationships.Tracks.Data[trackNum-1]
+	filename := fmt.Sprintf("%02d. %s.m4a", trackNum, ForbiddenNames.ReplaceAllString(track.Attributes.Name, ""))
+	return filepath.Join(sanAlbumFolder, filename)
+}
 
-		filename := fmt.Sprintf("%02d. %s.m4a", trackNum, ForbiddenNames.ReplaceAllString(track.Attributes.Name, ""))
+// RipTrack rips the track at the album position trackNum through the wrapper, unless its file already exists.
+// Failures are returned as *TrackError
+func RipTrack(ctx context.Context, meta *AutoGenerated, token string, storefront string, wrapper string, sanAlbumFolder string, trackNum int, opts RipOptions) error {
+	track := meta.Data[0].Relationships.Tracks.Data[trackNum-1]
+	trackPath := TrackPath(meta, sanAlbumFolder, trackNum)
 
-		trackPath := filepath.Join(sanAlbumFolder, filename)
+	exists, err := fileExists(trackPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		zerolog.Ctx(ctx).Debug().Msg("track already ripped")
+		return nil
+	}
 
-		exists, err := fileExists(trackPath)
+	manifest, err := getInfoFromAdam(ctx, track.ID, token, storefront, opts.Language)
+	if err != nil {
+		return &TrackError{Class: ClassSongInfo, Err: err}
+	}
+	if manifest == nil {
+		return &TrackError{Class: ClassUnavailable, Err: ErrSongMissing}
+	}
+	if manifest.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+		return &TrackError{Class: ClassUnavailable, Err: ErrNoLossless}
+	}
 
-		if err != nil {
-			return "", err
-		}
-		if !exists {
-			trackUrl, keys, err := extractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls)
-			if err != nil {
-				continue
-			}
+	trackUrl, keys, err := extractMedia(ctx, manifest.Attributes.ExtendedAssetUrls.EnhancedHls)
+	if err != nil {
+		return &TrackError{Class: ClassPlaylist, Err: err}
+	}
 
-			info, err := extractSong(trackUrl)
-			if err != nil {
-				continue
-			}
+	info, err := extractSong(ctx, trackUrl)
+	if err != nil {
+		return &TrackError{Class: ClassDownload, Err: err}
+	}
 
-			samplesOk := true
-			//goland:noinspection GoDfaConstantCondition
-			for samplesOk {
-				for _, i := range info.samples {
-					if int(i.descIndex) >= len(keys) {
-						samplesOk = false
-					}
-				}
-				break
-			}
-			if !samplesOk {
-				continue
-			}
-			err = decryptSong(wrapper, info, keys, meta, trackPath, trackNum, trackTotal)
-			if err != nil {
-				continue
-			}
+	for _, i := range info.samples {
+		if int(i.descIndex) >= len(keys) {
+			return &TrackError{Class: ClassMalformed, Err: ErrUnknownKeys}
 		}
 	}
 
-	return sanAlbumFolder, nil
+	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
+	err = decryptSong(ctx, wrapper, info, keys, meta, trackPath, trackNum, trackTotal)
+	if err != nil {
+		return &TrackError{Class: ClassWrapper, Err: err}
+	}
+	return nil
 }
 
-func extractMedia(b string) (string, []string, error) {
+func extractMedia(ctx context.Context, b string) (string, []string, error) {
 	masterUrl, err := url.Parse(b)
 	if err != nil {
 		return "", nil, err
 	}
-	resp, err := http.Get(b)
+	req, err := http.NewRequestWithContext(ctx, "GET", b, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", nil, err
 	}
@@ -1045,7 +1141,7 @@ func extractMedia(b string) (string, []string, error) {
 		_ = Body.Close()
 	}(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return "", nil, errors.New(resp.Status)
+		return "", nil, newHTTPError(resp)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -1054,7 +1150,7 @@ func extractMedia(b string) (string, []string, error) {
 	masterString := string(body)
 	from, listType, err := m3u8.DecodeFrom(strings.NewReader(masterString), true)
 	if err != nil || listType != m3u8.MASTER {
-		return "", nil, errors.New("m3u8 not of master type")
+		return "", nil, ErrNotMaster
 	}
 	master := from.(*m3u8.MasterPlaylist)
 	var streamUrl *url.URL
@@ -1072,7 +1168,7 @@ func extractMedia(b string) (string, []string, error) {
 		}
 	}
 	if streamUrl == nil {
-		return "", nil, errors.New("no alac codec found")
+		return "", nil, ErrNoAlac
 	}
 	var keys []string
 	keys = append(keys, prefetchKey)
@@ -1087,8 +1183,12 @@ func extractMedia(b string) (string, []string, error) {
 	return streamUrl.String(), keys, nil
 }
 
-func extractSong(url string) (*SongInfo, error) {
-	track, err := http.Get(url)
+func extractSong(ctx context.Context, url string) (*SongInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	track, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -1096,7 +1196,7 @@ func extractSong(url string) (*SongInfo, error) {
 		_ = Body.Close()
 	}(track.Body)
 	if track.StatusCode != http.StatusOK {
-		return nil, errors.New(track.Status)
+		return nil, newHTTPError(track)
 	}
 	rawSong, err := io.ReadAll(track.Body)
 	if err != nil {
@@ -1211,7 +1311,7 @@ func extractSong(url string) (*SongInfo, error) {
 			}
 		}
 		if len(mdat) != 0 {
-			return nil, errors.New("offset mismatch")
+			return nil, ErrOffsetMismatch
 		}
 	}
 
@@ -1224,14 +1324,17 @@ func init() {
 
 func BoxTypeAlac() mp4.BoxType { return mp4.StrToBoxType("alac") }
 
-func getInfoFromAdam(adamId string, token string, storefront string) (*SongData, error) {
-	request, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/songs/%s", storefront, adamId), nil)
+func getInfoFromAdam(ctx context.Context, adamId string, token string, storefront string, language string) (*SongData, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/catalog/%s/songs/%s", ApiUrl, storefront, adamId), nil)
 	if err != nil {
 		return nil, err
 	}
 	query := url.Values{}
 	query.Set("extend", "extendedAssetUrls")
 	query.Set("include", "albums")
+	if language != "" {
+		query.Set("l", language)
+	}
 	request.URL.RawQuery = query.Encode()
 
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
@@ -1246,7 +1349,7 @@ func getInfoFromAdam(adamId string, token string, storefront string) (*SongData,
 		_ = Body.Close()
 	}(do.Body)
 	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+		return nil, newHTTPError(do)
 	}
 
 	obj := new(ApiResult)
@@ -1262,49 +1365,3 @@ func getInfoFromAdam(adamId string, token string, storefront string) (*SongData,
 	}
 	return nil, nil
 }
-
-func getToken() (string, error) {
-	req, err := http.NewRequest("GET", "https://beta.music.apple.com", nil)
-	if err != nil {
-		return "", err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	regex := regexp.MustCompile(`/assets/index-legacy-[^/]+\.js`)
-	indexJsUri := regex.FindString(string(body))
-
-	req, err = http.NewRequest("GET", "https://beta.music.apple.com"+indexJsUri, nil)
-	if err != nil {
-		return "", err
-	}
-
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-
-	body, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	regex = regexp.MustCompile(`eyJh([^"]*)`)
-	token := regex.FindString(string(body))
-
-	return token, nil
-}
@@ -0,0 +1,44 @@
+package ripper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Search looks up albums, songs and artists matching the term in the catalog of the storefront
+func Search(ctx context.Context, term string, types []string, limit int, token string, storefront string) (*SearchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/catalog/%s/search", ApiUrl, storefront), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("term", term)
+	query.Set("types", strings.Join(types, ","))
+	query.Set("limit", strconv.Itoa(limit))
+	req.URL.RawQuery = query.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(do.Body)
+	if do.StatusCode != http.StatusOK {
+		return nil, newHTTPError(do)
+	}
+	obj := new(SearchResult)
+	err = json.NewDecoder(do.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
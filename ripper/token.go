@@ -0,0 +1,149 @@
+package ripper
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"ripper-api/store"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// tokenRefreshAhead is how long before its expiry a cached token is replaced
+	tokenRefreshAhead = 24 * time.Hour
+	// tokenFallbackTTL is how long a token without a readable expiry is cached
+	tokenFallbackTTL = time.Hour
+)
+
+var (
+	indexJsPattern = regexp.MustCompile(`/assets/index-legacy-[^/]+\.js`)
+	tokenPattern   = regexp.MustCompile(`eyJh([^"]*)`)
+
+	// refreshMu keeps the rips of a process from scraping a new token all at once
+	refreshMu sync.Mutex
+)
+
+// GetToken returns the developer token cached in the store, scraping a new one from the web player
+// once the cached one is about to expire
+func GetToken(ctx context.Context, st *store.Store) (string, error) {
+	token, err := st.Token(ctx)
+	if err != nil || token != "" {
+		return token, err
+	}
+	return RefreshToken(ctx, st, "")
+}
+
+// RefreshToken replaces the rejected token. If another rip already replaced it, that token is returned instead
+func RefreshToken(ctx context.Context, st *store.Store, rejected string) (string, error) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	token, err := st.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	if token != "" && token != rejected {
+		return token, nil
+	}
+
+	token, err = fetchToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get token: %w", err)
+	}
+
+	// short lived tokens are replaced halfway through their lifetime instead
+	ttl := tokenFallbackTTL
+	expiry, err := tokenExpiry(token)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("expiry of the token unknown")
+	} else if left := time.Until(expiry); left > 2*tokenRefreshAhead {
+		ttl = left - tokenRefreshAhead
+	} else if left > 0 {
+		ttl = left / 2
+	}
+	if err := st.SetToken(ctx, token, ttl); err != nil {
+		return "", err
+	}
+	zerolog.Ctx(ctx).Info().Time("refreshAt", time.Now().Add(ttl)).Msg("token refreshed")
+	return token, nil
+}
+
+// fetchToken scrapes the token from the JavaScript of the web player
+func fetchToken(ctx context.Context) (string, error) {
+	body, err := fetchPage(ctx, WebPlayerUrl)
+	if err != nil {
+		return "", err
+	}
+	indexJsUri := indexJsPattern.FindString(body)
+	if indexJsUri == "" {
+		return "", errors.New("no index script on the web player page")
+	}
+
+	body, err = fetchPage(ctx, WebPlayerUrl+indexJsUri)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPattern.FindString(body)
+	if token == "" {
+		return "", errors.New("no token in the index script")
+	}
+	return token, nil
+}
+
+func fetchPage(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	// not an HTTPError, the answers of the web player say nothing about the rip that needs the token
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// tokenExpiry reads the exp claim of the token, which is a JWT. The signature isn't checked, Apple does that
+func tokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("token has no expiry")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,257 @@
+package ripper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/rs/zerolog"
+)
+
+const TypeTrack = "download:track"
+
+const (
+	// trackPoll is how often an album rip checks on its tracks
+	trackPoll = 2 * time.Second
+	// trackRetention keeps finished tracks around long enough for their album to notice
+	trackRetention = time.Hour
+)
+
+// TrackPayload is a single track of an album rip, the album metadata is shared through the store
+type TrackPayload struct {
+	Key        string
+	AlbumId    string
+	Storefront string
+	Folder     string
+	// Position of the track in the album, starting at 1
+	Position int
+	Options  RipOptions
+}
+
+func NewTrackTask(p TrackPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(TypeTrack, payload), nil
+}
+
+// trackTaskId names the task of a track after the album rip, so a retried rip finds the tracks of earlier attempts
+func trackTaskId(jobId string, position int) string {
+	return jobId + ":" + strconv.Itoa(position)
+}
+
+// HandleTrackTask leases a wrapper and rips one track of an album
+func (h *TaskHandler) HandleTrackTask(ctx context.Context, t *asynq.Task) error {
+	var p TrackPayload
+
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	taskId, _ := asynq.GetTaskID(ctx)
+	queue, _ := asynq.GetQueueName(ctx)
+	logger := zerolog.Ctx(ctx).With().
+		Str("job", p.Key).
+		Str("album", p.AlbumId).
+		Str("storefront", p.Storefront).
+		Int("track", p.Position).
+		Logger()
+	ctx = logger.WithContext(ctx)
+
+	raw, err := h.Store.AlbumMeta(ctx, p.Key)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		return fmt.Errorf("metadata of the album is gone: %w", asynq.SkipRetry)
+	}
+	meta := new(AutoGenerated)
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if p.Position < 1 || p.Position > len(meta.Data[0].Relationships.Tracks.Data) {
+		return fmt.Errorf("track %d is not on the album: %w", p.Position, asynq.SkipRetry)
+	}
+	logger = logger.With().Str("song", meta.Data[0].Relationships.Tracks.Data[p.Position-1].ID).Logger()
+	ctx = logger.WithContext(ctx)
+
+	// fetched here rather than queued with the track, so a backlog never runs with a stale token
+	token, err := GetToken(ctx, h.Store)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get token")
+		return err
+	}
+
+	// wrappers are labelled with the priorities they are reserved for
+	wrapper, release, err := h.leaseWrapper(ctx, taskId, PriorityOf(queue))
+	if err != nil {
+		return err
+	}
+	logger = logger.With().Str("wrapper", wrapper).Logger()
+	ctx = logger.WithContext(ctx)
+
+	err = RipTrack(ctx, meta, token, p.Storefront, wrapper, p.Folder, p.Position, p.Options)
+	if FailureKind(err) == KindAuth {
+		logger.Info().Msg("token rejected, retrying with a fresh one")
+		token, tErr := RefreshToken(ctx, h.Store, token)
+		if tErr != nil {
+			logger.Error().Err(tErr).Msg("failed to refresh token")
+		} else {
+			err = RipTrack(ctx, meta, token, p.Storefront, wrapper, p.Folder, p.Position, p.Options)
+		}
+	}
+	release()
+	if err != nil {
+		if FailureKind(err) == KindWrapper {
+			if sErr := h.Store.SetFailedWrapper(ctx, taskId, wrapper, failedWrapperTTL); sErr != nil {
+				logger.Warn().Err(sErr).Msg("failed to record failed wrapper")
+			}
+		}
+		h.reportTrack(ctx, &p, meta, err)
+		logger.Error().Err(err).Str("kind", FailureKind(err)).Msg("track failed")
+		return withRetryPolicy(err)
+	}
+	logger.Debug().Msg("track ripped")
+	return nil
+}
+
+// reportTrack records why the track failed, for the report of its album
+func (h *TaskHandler) reportTrack(ctx context.Context, p *TrackPayload, meta *AutoGenerated, err error) {
+	track := meta.Data[0].Relationships.Tracks.Data[p.Position-1]
+	report := TrackReport{Position: p.Position, Id: track.ID, Title: track.Attributes.Name, Status: TrackFailed, Class: "unknown", Kind: FailureKind(err), Error: err.Error()}
+	var trackErr *TrackError
+	if errors.As(err, &trackErr) {
+		report.Class, report.Error = trackErr.Class, trackErr.Err.Error()
+	}
+
+	raw, mErr := json.Marshal(report)
+	if mErr == nil {
+		mErr = h.Store.SetTrackReport(ctx, p.Key, p.Position, raw, trackRetention)
+	}
+	if mErr != nil {
+		zerolog.Ctx(ctx).Warn().Err(mErr).Msg("failed to record track report")
+	}
+}
+
+// ripTracks hands the selected tracks that aren't ripped yet to the track queue and waits for all of them.
+// It returns the error of every track that failed for good, keyed by album position
+func (h *TaskHandler) ripTracks(ctx context.Context, p *RipPayload, key string, folder string, meta *AutoGenerated) (map[int]string, error) {
+	jobId, _ := asynq.GetTaskID(ctx)
+	queue, _ := asynq.GetQueueName(ctx)
+	queue = TrackQueueName(PriorityOf(queue))
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	deadline, _ := ctx.Deadline()
+
+	pending := make(map[int]string)
+	for i, track := range meta.Data[0].Relationships.Tracks.Data {
+		position := i + 1
+		if !p.Options.Selects(position, track.Attributes.DiscNumber, track.Attributes.TrackNumber, track.ID) {
+			continue
+		}
+		exists, err := fileExists(TrackPath(meta, folder, position))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+
+		id := trackTaskId(jobId, position)
+		if err := h.enqueueTrack(queue, id, TrackPayload{
+			Key:        key,
+			AlbumId:    p.AlbumId,
+			Storefront: p.Storefront,
+			Folder:     folder,
+			Position:   position,
+			Options:    p.Options,
+		}, asynq.MaxRetry(maxRetry), asynq.Deadline(deadline)); err != nil {
+			h.cancelTracks(queue, pending)
+			return nil, err
+		}
+		pending[position] = id
+	}
+
+	failed := make(map[int]string)
+	ticker := time.NewTicker(trackPoll)
+	defer ticker.Stop()
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			h.cancelTracks(queue, pending)
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		for position, id := range pending {
+			info, err := h.Inspector.GetTaskInfo(queue, id)
+			if errors.Is(err, asynq.ErrTaskNotFound) {
+				// a finished task may have been removed, the file tells whether the track made it
+				exists, fErr := fileExists(TrackPath(meta, folder, position))
+				if fErr != nil {
+					h.cancelTracks(queue, pending)
+					return nil, fErr
+				}
+				if !exists {
+					failed[position] = "track task disappeared"
+				}
+				delete(pending, position)
+				continue
+			}
+			if err != nil {
+				h.cancelTracks(queue, pending)
+				return nil, err
+			}
+			switch info.State {
+			case asynq.TaskStateCompleted:
+				delete(pending, position)
+			case asynq.TaskStateArchived:
+				failed[position] = info.LastErr
+				delete(pending, position)
+			}
+		}
+	}
+	return failed, nil
+}
+
+// enqueueTrack enqueues the track task, replacing a finished one left over from an earlier attempt of the rip
+func (h *TaskHandler) enqueueTrack(queue string, id string, p TrackPayload, opts ...asynq.Option) error {
+	task, err := NewTrackTask(p)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, asynq.TaskID(id), asynq.Queue(queue), asynq.Retention(trackRetention))
+
+	_, err = h.Client.Enqueue(task, opts...)
+	if !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return err
+	}
+
+	info, err := h.Inspector.GetTaskInfo(queue, id)
+	if err != nil {
+		return err
+	}
+	if info.State != asynq.TaskStateArchived && info.State != asynq.TaskStateCompleted {
+		// still on its way, the rip can wait for it
+		return nil
+	}
+	if err := h.Inspector.DeleteTask(queue, id); err != nil {
+		return err
+	}
+	_, err = h.Client.Enqueue(task, opts...)
+	return err
+}
+
+// cancelTracks drops the tracks that haven't started and stops the running ones
+func (h *TaskHandler) cancelTracks(queue string, pending map[int]string) {
+	for _, id := range pending {
+		if err := h.Inspector.DeleteTask(queue, id); err != nil {
+			_ = h.Inspector.CancelProcessing(id)
+		}
+	}
+}
@@ -14,6 +14,10 @@ const (
 
 var (
 	ForbiddenNames = regexp.MustCompile(`[/\\<>:"|?*]`)
+	// ApiUrl is the base URL of the catalog API
+	ApiUrl = "https://amp-api.music.apple.com"
+	// WebPlayerUrl is the web player the developer token is scraped from
+	WebPlayerUrl = "https://beta.music.apple.com"
 )
 
 type SampleInfo struct {
@@ -329,3 +333,60 @@ type Alac struct {
 	AvgBitRate        uint32 `mp4:"size=32"`
 	SampleRate        uint32 `mp4:"size=32"`
 }
+
+type Artwork struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+type SearchResult struct {
+	Results struct {
+		Albums struct {
+			Data []struct {
+				ID         string `json:"id"`
+				Type       string `json:"type"`
+				Attributes struct {
+					Artwork     Artwork  `json:"artwork"`
+					ArtistName  string   `json:"artistName"`
+					Name        string   `json:"name"`
+					URL         string   `json:"url"`
+					ReleaseDate string   `json:"releaseDate"`
+					TrackCount  int      `json:"trackCount"`
+					IsSingle    bool     `json:"isSingle"`
+					AudioTraits []string `json:"audioTraits"`
+				} `json:"attributes"`
+			} `json:"data"`
+		} `json:"albums"`
+		Songs struct {
+			Data []struct {
+				ID         string `json:"id"`
+				Type       string `json:"type"`
+				Attributes struct {
+					Artwork          Artwork  `json:"artwork"`
+					ArtistName       string   `json:"artistName"`
+					AlbumName        string   `json:"albumName"`
+					Name             string   `json:"name"`
+					URL              string   `json:"url"`
+					DurationInMillis int      `json:"durationInMillis"`
+					DiscNumber       int      `json:"discNumber"`
+					TrackNumber      int      `json:"trackNumber"`
+					Isrc             string   `json:"isrc"`
+					AudioTraits      []string `json:"audioTraits"`
+				} `json:"attributes"`
+			} `json:"data"`
+		} `json:"songs"`
+		Artists struct {
+			Data []struct {
+				ID         string `json:"id"`
+				Type       string `json:"type"`
+				Attributes struct {
+					Artwork    Artwork  `json:"artwork"`
+					Name       string   `json:"name"`
+					URL        string   `json:"url"`
+					GenreNames []string `json:"genreNames"`
+				} `json:"attributes"`
+			} `json:"data"`
+		} `json:"artists"`
+	} `json:"results"`
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"ripper-api/audit"
+
+	"github.com/labstack/echo/v4"
+)
+
+const auditContextKey = "audit"
+
+// Audited records an audit event for every request to the route. Handlers fill in what they know
+// about the job through auditEvent, status and bytes served are added once they're done
+func Audited(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cc := c.(*ConfigContext)
+			if !cc.Audit.Enabled() {
+				return next(c)
+			}
+
+			event := &audit.Event{
+				Time:      time.Now().UTC(),
+				Action:    action,
+				KeyId:     keyId(c.Request().Header.Get("Api-Key")),
+				IP:        c.RealIP(),
+				RequestId: c.Response().Header().Get(echo.HeaderXRequestID),
+			}
+			c.Set(auditContextKey, event)
+
+			err := next(c)
+
+			event.Status = c.Response().Status
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				event.Status = he.Code
+			} else if err != nil {
+				event.Status = http.StatusInternalServerError
+			}
+			event.Bytes = c.Response().Size
+			if event.Outcome == "" {
+				switch {
+				case event.Status >= http.StatusInternalServerError:
+					event.Outcome = "error"
+				case event.Status >= http.StatusBadRequest:
+					event.Outcome = "rejected"
+				default:
+					event.Outcome = "ok"
+				}
+			}
+
+			if aErr := cc.Audit.Record(c.Request().Context(), event); aErr != nil {
+				c.Logger().Errorf("failed to record audit event: %v", aErr)
+			}
+			return err
+		}
+	}
+}
+
+// auditEvent returns the audit event of the request, or a throwaway one if the route isn't audited
+func auditEvent(c echo.Context) *audit.Event {
+	if event, ok := c.Get(auditContextKey).(*audit.Event); ok {
+		return event
+	}
+	return &audit.Event{}
+}
+
+// keyId identifies an api key in the audit log without revealing it
+func keyId(key string) string {
+	return hashKey(key)[:12]
+}
+
+func isAdminKey(config *Config, key string) bool {
+	for _, line := range config.AdminKeys {
+		if key == line {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAdmin only lets AdminKeys through
+func RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cc := c.(*ConfigContext)
+		if !isAdminKey(cc.Config, c.Request().Header.Get("Api-Key")) {
+			msg := &Message{
+				Msg: "This endpoint requires an admin key",
+			}
+			return c.JSON(http.StatusForbidden, msg)
+		}
+		return next(c)
+	}
+}
+
+func QueryAudit(c echo.Context) error {
+	cc := c.(*ConfigContext)
+
+	query := new(AuditQuery)
+
+	if err := c.Bind(query); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(query); err != nil {
+		return err
+	}
+
+	to := time.Now()
+	if query.To != nil {
+		to = *query.To
+	}
+	from := to.Add(-24 * time.Hour)
+	if query.From != nil {
+		from = *query.From
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = 1000
+	}
+
+	events, err := cc.Audit.Query(c.Request().Context(), query.Key, from, to, limit)
+	if err != nil {
+		c.Logger().Errorf("failed to query audit log: %v", err)
+		return returnError(err, c)
+	}
+	return c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"ripper-api/ripper"
+
+	"github.com/labstack/echo/v4"
+)
+
+func artworkUrl(template string, width int, height int) string {
+	return strings.Replace(template, "{w}x{h}", fmt.Sprintf("%dx%d", width, height), 1)
+}
+
+func newAlbumPreview(meta *ripper.AutoGenerated) *AlbumPreview {
+	album := meta.Data[0]
+
+	preview := &AlbumPreview{
+		Id:          album.ID,
+		Title:       album.Attributes.Name,
+		Artist:      album.Attributes.ArtistName,
+		Label:       album.Attributes.RecordLabel,
+		Upc:         album.Attributes.Upc,
+		ReleaseDate: album.Attributes.ReleaseDate,
+		Copyright:   album.Attributes.Copyright,
+		Genres:      album.Attributes.GenreNames,
+		AudioTraits: album.Attributes.AudioTraits,
+		Artwork:     artworkUrl(album.Attributes.Artwork.URL, album.Attributes.Artwork.Width, album.Attributes.Artwork.Height),
+		TrackCount:  len(album.Relationships.Tracks.Data),
+		Tracks:      make([]TrackPreview, 0, len(album.Relationships.Tracks.Data)),
+	}
+
+	for i, track := range album.Relationships.Tracks.Data {
+		preview.DurationMs += track.Attributes.DurationInMillis
+		preview.Tracks = append(preview.Tracks, TrackPreview{
+			Position:    i + 1,
+			Disc:        track.Attributes.DiscNumber,
+			TrackNumber: track.Attributes.TrackNumber,
+			Id:          track.ID,
+			Title:       track.Attributes.Name,
+			Artist:      track.Attributes.ArtistName,
+			Composer:    track.Attributes.ComposerName,
+			DurationMs:  track.Attributes.DurationInMillis,
+			Duration:    formatDuration(track.Attributes.DurationInMillis),
+			Isrc:        track.Attributes.Isrc,
+			AudioTraits: track.Attributes.AudioTraits,
+		})
+	}
+	preview.Duration = formatDuration(preview.DurationMs)
+
+	return preview
+}
+
+// formatDuration turns milliseconds into m:ss, or h:mm:ss for anything longer than an hour
+func formatDuration(ms int) string {
+	s := ms / 1000
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+func PreviewAlbum(c echo.Context) error {
+	cc := c.(*ConfigContext)
+	query := new(PreviewQuery)
+
+	if err := c.Bind(query); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(query); err != nil {
+		return err
+	}
+
+	storefront, albumId := checkUrl(query.Url)
+
+	if storefront == "" && albumId == "" {
+		msg := &Message{
+			Msg: fmt.Sprintf("Invalid link: %v", query.Url),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	ctx := c.Request().Context()
+	token, err := ripper.GetToken(ctx, cc.Store)
+	if err != nil {
+		c.Logger().Errorf("failed to get token: %v", err)
+		return returnError(err, c)
+	}
+
+	meta, err := ripper.GetMeta(ctx, albumId, token, storefront, query.Language)
+	if ripper.FailureKind(err) == ripper.KindAuth {
+		if token, err = ripper.RefreshToken(ctx, cc.Store, token); err == nil {
+			meta, err = ripper.GetMeta(ctx, albumId, token, storefront, query.Language)
+		}
+	}
+	if catalogStatus(err) == http.StatusNotFound {
+		return c.JSON(http.StatusNotFound, &Message{Msg: fmt.Sprintf("Album %v not found in storefront %v", albumId, storefront)})
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to get album metadata: %v", err)
+		return catalogError(err, c)
+	}
+	if len(meta.Data) == 0 {
+		return c.JSON(http.StatusNotFound, &Message{Msg: fmt.Sprintf("Album %v not found", albumId)})
+	}
+
+	metaStorefront := strings.ToLower(query.MetaStorefront)
+	if metaStorefront != "" && metaStorefront != storefront {
+		localized, err := ripper.GetMeta(ctx, albumId, token, metaStorefront, query.Language)
+		if err != nil {
+			c.Logger().Errorf("failed to get localized album metadata: %v", err)
+			if catalogStatus(err) == http.StatusNotFound {
+				return c.JSON(http.StatusNotFound, &Message{Msg: fmt.Sprintf("Album %v not found in storefront %v", albumId, metaStorefront)})
+			}
+			return catalogError(err, c)
+		}
+		ripper.Localize(meta, localized)
+	}
+
+	return c.JSON(http.StatusOK, newAlbumPreview(meta))
+}
+
+// catalogStatus is the status to answer with for a failed catalog request: the status of a 4xx answer of the
+// catalog API, which is about the request, or 500. A rejected token is a problem on this side, so 401 is a 500 too
+func catalogStatus(err error) int {
+	var httpErr *ripper.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 && httpErr.StatusCode != http.StatusUnauthorized {
+		return httpErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+func catalogError(err error, c echo.Context) error {
+	return c.JSON(catalogStatus(err), &Message{Msg: err.Error()})
+}
+
+var searchTypes = []string{"albums", "songs", "artists"}
+
+func newSearchResults(result *ripper.SearchResult, storefront string) *SearchResults {
+	res := &SearchResults{
+		Albums:  make([]SearchAlbum, 0, len(result.Results.Albums.Data)),
+		Songs:   make([]SearchSong, 0, len(result.Results.Songs.Data)),
+		Artists: make([]SearchArtist, 0, len(result.Results.Artists.Data)),
+	}
+
+	for _, album := range result.Results.Albums.Data {
+		attr := album.Attributes
+		res.Albums = append(res.Albums, SearchAlbum{
+			Id:          album.ID,
+			Title:       attr.Name,
+			Artist:      attr.ArtistName,
+			ReleaseDate: attr.ReleaseDate,
+			TrackCount:  attr.TrackCount,
+			IsSingle:    attr.IsSingle,
+			AudioTraits: attr.AudioTraits,
+			Artwork:     artworkUrl(attr.Artwork.URL, attr.Artwork.Width, attr.Artwork.Height),
+			Url:         attr.URL,
+			Submit:      SubmittedUrl{Id: album.ID, Storefront: storefront},
+		})
+	}
+
+	for _, song := range result.Results.Songs.Data {
+		attr := song.Attributes
+		// song links point at the album, with the song in the query
+		_, albumId := checkUrl(attr.URL)
+		res.Songs = append(res.Songs, SearchSong{
+			Id:          song.ID,
+			Title:       attr.Name,
+			Artist:      attr.ArtistName,
+			Album:       attr.AlbumName,
+			AlbumId:     albumId,
+			Disc:        attr.DiscNumber,
+			TrackNumber: attr.TrackNumber,
+			DurationMs:  attr.DurationInMillis,
+			Duration:    formatDuration(attr.DurationInMillis),
+			Isrc:        attr.Isrc,
+			AudioTraits: attr.AudioTraits,
+			Artwork:     artworkUrl(attr.Artwork.URL, attr.Artwork.Width, attr.Artwork.Height),
+			Url:         attr.URL,
+			Submit:      SubmittedUrl{Id: albumId, Storefront: storefront, Tracks: []string{song.ID}},
+		})
+	}
+
+	for _, artist := range result.Results.Artists.Data {
+		attr := artist.Attributes
+		res.Artists = append(res.Artists, SearchArtist{
+			Id:      artist.ID,
+			Name:    attr.Name,
+			Genres:  attr.GenreNames,
+			Artwork: artworkUrl(attr.Artwork.URL, attr.Artwork.Width, attr.Artwork.Height),
+			Url:     attr.URL,
+		})
+	}
+
+	return res
+}
+
+func SearchCatalog(c echo.Context) error {
+	cc := c.(*ConfigContext)
+	query := new(SearchQuery)
+
+	if err := c.Bind(query); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(query); err != nil {
+		return err
+	}
+
+	types := searchTypes
+	if query.Types != "" {
+		types = strings.Split(query.Types, ",")
+		for _, t := range types {
+			if !slices.Contains(searchTypes, t) {
+				msg := &Message{
+					Msg: fmt.Sprintf("Unknown search type: %v", t),
+				}
+				return c.JSON(http.StatusBadRequest, msg)
+			}
+		}
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = 10
+	}
+
+	storefront := strings.ToLower(query.Storefront)
+
+	ctx := c.Request().Context()
+	token, err := ripper.GetToken(ctx, cc.Store)
+	if err != nil {
+		c.Logger().Errorf("failed to get token: %v", err)
+		return returnError(err, c)
+	}
+
+	result, err := ripper.Search(ctx, query.Term, types, limit, token, storefront)
+	if ripper.FailureKind(err) == ripper.KindAuth {
+		if token, err = ripper.RefreshToken(ctx, cc.Store, token); err == nil {
+			result, err = ripper.Search(ctx, query.Term, types, limit, token, storefront)
+		}
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to search catalog: %v", err)
+		return catalogError(err, c)
+	}
+
+	return c.JSON(http.StatusOK, newSearchResults(result, storefront))
+}
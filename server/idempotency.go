@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"ripper-api/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	HeaderReplayed       = "Idempotent-Replayed"
+)
+
+// idempotencyPending is how long a key stays reserved for a request that never gets to release it
+const idempotencyPending = time.Minute
+
+// recorder keeps a copy of everything written to the response
+type recorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func hashKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Idempotent replays the response of an earlier request with the same Idempotency-Key header,
+// instead of handling it again. Keys are scoped to the api key and remembered for IdempotencyWindow
+func Idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cc := c.(*ConfigContext)
+
+		header := c.Request().Header.Get(HeaderIdempotencyKey)
+		if header == "" {
+			return next(c)
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			msg := &Message{
+				Msg: err.Error(),
+			}
+			return c.JSON(http.StatusBadRequest, msg)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request().Context()
+		key := hashKey(c.Request().Header.Get("Api-Key")) + ":" + header
+		hash := hashKey(string(body))
+
+		record, err := cc.Store.BeginIdempotent(ctx, key, hash, idempotencyPending)
+		if err != nil {
+			c.Logger().Errorf("failed to check idempotency key: %v", err)
+			return returnError(err, c)
+		}
+
+		if record != nil {
+			switch {
+			case record.Hash != hash:
+				msg := &Message{
+					Msg: "Idempotency-Key was already used for a different request",
+				}
+				return c.JSON(http.StatusUnprocessableEntity, msg)
+			case record.Pending:
+				msg := &Message{
+					Msg: "A request with this Idempotency-Key is still being processed",
+				}
+				return c.JSON(http.StatusConflict, msg)
+			default:
+				c.Response().Header().Set(HeaderReplayed, "true")
+				return c.JSONBlob(record.Status, record.Body)
+			}
+		}
+
+		rec := &recorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = rec
+
+		// the client may be gone by now, which is when it retries, so the key is released regardless.
+		// Releasing it in a defer covers panics too
+		ctx = context.WithoutCancel(ctx)
+		finished := false
+		defer func() {
+			if finished {
+				return
+			}
+			if aErr := cc.Store.AbortIdempotent(ctx, key); aErr != nil {
+				c.Logger().Errorf("failed to release idempotency key: %v", aErr)
+			}
+		}()
+
+		err = next(c)
+
+		// only remember definite answers, errors are worth retrying
+		status := c.Response().Status
+		if err != nil || status >= http.StatusInternalServerError {
+			return err
+		}
+
+		finished = true
+		record = &store.IdempotentRecord{Hash: hash, Status: status, Body: rec.body.Bytes()}
+		if err := cc.Store.FinishIdempotent(ctx, key, record, cc.IdempotencyWindow); err != nil {
+			c.Logger().Errorf("failed to store idempotent response: %v", err)
+		}
+		return nil
+	}
+}
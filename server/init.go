@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"net"
 	"net/http"
+	"regexp"
+	"ripper-api/audit"
 	"ripper-api/ripper"
+	"ripper-api/store"
 
 	"github.com/go-playground/validator"
 	"github.com/hibiken/asynq"
@@ -14,28 +18,40 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// languageTag loosely matches BCP 47 tags like "en", "en-GB" or "zh-Hant-TW"
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// trackSelection matches a track position like "#3", a disc and track number like "2:5", or a song ID
+var trackSelection = regexp.MustCompile(`^(#\d+|\d+:\d+|\d+)$`)
+
 func (cv *CustomValidator) Validate(i interface{}) error {
 	if err := cv.validator.Struct(i); err != nil {
+		var errs validator.ValidationErrors
+		if errors.As(err, &errs) && errs[0].Tag() == "track" {
+			msg := fmt.Sprintf(`invalid track %q: use "#3" for a position (1-based across discs), "2:5" for a disc and track number, or a song ID`, errs[0].Value())
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 	return nil
 }
 
-func createEcho(config *Config, logger zerolog.Logger, asynqClient *asynq.Client, asynqInspector *asynq.Inspector) *echo.Echo {
+func createEcho(config *Config, logger zerolog.Logger, asynqClient *asynq.Client, asynqInspector *asynq.Inspector, st *store.Store, auditLog *audit.Log) *echo.Echo {
 	e := echo.New()
 
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			cc := &ConfigContext{c, config, asynqClient, asynqInspector}
+			cc := &ConfigContext{c, config, asynqClient, asynqInspector, st, auditLog}
 			return next(cc)
 		}
 	})
 
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		LogURI:    true,
-		LogStatus: true,
-		LogMethod: true,
-		LogError:  true,
+		LogURI:       true,
+		LogStatus:    true,
+		LogMethod:    true,
+		LogError:     true,
+		LogRequestID: true,
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
 			if v.Error == nil {
 				logger.Info().
@@ -43,6 +59,7 @@ func createEcho(config *Config, logger zerolog.Logger, asynqClient *asynq.Client
 					Str("IP", v.RemoteIP).
 					Int("status", v.Status).
 					Str("method", v.Method).
+					Str("request_id", v.RequestID).
 					Msg("request")
 			} else {
 				logger.Error().
@@ -50,6 +67,7 @@ func createEcho(config *Config, logger zerolog.Logger, asynqClient *asynq.Client
 					Str("IP", v.RemoteIP).
 					Int("status", v.Status).
 					Str("method", v.Method).
+					Str("request_id", v.RequestID).
 					Err(v.Error).
 					Msg("request")
 			}
@@ -63,7 +81,18 @@ func createEcho(config *Config, logger zerolog.Logger, asynqClient *asynq.Client
 	e.Use(middleware.Recover())
 	e.Pre(middleware.AddTrailingSlash())
 
-	e.Validator = &CustomValidator{validator: validator.New()}
+	v := validator.New()
+	_ = v.RegisterValidation("language", func(fl validator.FieldLevel) bool {
+		return languageTag.MatchString(fl.Field().String())
+	})
+	_ = v.RegisterValidation("track", func(fl validator.FieldLevel) bool {
+		return trackSelection.MatchString(fl.Field().String())
+	})
+	_ = v.RegisterValidation("hostport", func(fl validator.FieldLevel) bool {
+		host, port, err := net.SplitHostPort(fl.Field().String())
+		return err == nil && host != "" && port != ""
+	})
+	e.Validator = &CustomValidator{validator: v}
 
 	e.Use(middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
 		KeyLookup: "header:Api-Key",
@@ -73,50 +102,80 @@ func createEcho(config *Config, logger zerolog.Logger, asynqClient *asynq.Client
 					return true, nil
 				}
 			}
-			return false, nil
+			return isAdminKey(config, key), nil
 		},
 	}))
 
-	e.POST("/", ProcessLink)
-	e.GET("/job/", ProcessRequestID)
+	e.POST("/", ProcessLink, Audited(audit.ActionSubmit), Idempotent)
+	e.GET("/job/", ProcessRequestID, Audited(audit.ActionDownload))
+	e.GET("/job/status/", JobReport)
+	e.GET("/meta/", PreviewAlbum)
+	e.GET("/search/", SearchCatalog)
+
+	admin := e.Group("/admin", RequireAdmin)
+	admin.GET("/audit/", QueryAudit)
+	admin.GET("/wrappers/", ListWrappers)
+	admin.POST("/wrappers/", AddWrapper)
+	admin.POST("/wrappers/drain/", DrainWrapper)
+	admin.DELETE("/wrappers/", RemoveWrapper)
 
 	return e
 }
 
-func CreateEchoWithServer(ctx context.Context, config *Config) (*echo.Echo, *http.Server) {
+// CreateEchoWithServer sets up the api, the returned func closes what it opened once the server has been shut down
+func CreateEchoWithServer(ctx context.Context, config *Config) (*echo.Echo, *http.Server, func(), error) {
 	logger := zerolog.Ctx(ctx)
 
-	asynqClient := asynq.NewClient(&asynq.RedisClientOpt{
-		Addr:     config.AddressRedis,
-		Password: config.RedisPw,
-		DB:       0,
-	})
+	asynqClient := asynq.NewClient(config.Redis)
 
-	asynqInspector := asynq.NewInspector(&asynq.RedisClientOpt{
-		Addr:     config.AddressRedis,
-		Password: config.RedisPw,
-		DB:       0,
-	})
+	asynqInspector := asynq.NewInspector(config.Redis)
+
+	st, err := store.New(config.Redis)
+	if err != nil {
+		_ = asynqClient.Close()
+		_ = asynqInspector.Close()
+		return nil, nil, nil, err
+	}
+
+	auditLog, err := audit.Open(config.AuditLog, st, config.AuditStream)
+	if err != nil {
+		_ = asynqClient.Close()
+		_ = asynqInspector.Close()
+		_ = st.Close()
+		return nil, nil, nil, err
+	}
+
+	closeAll := func() {
+		// the audit log goes first, it may write to the store
+		if err := auditLog.Close(); err != nil {
+			logger.Error().Err(err).Msg("failed to close the audit log")
+		}
+		_ = asynqClient.Close()
+		_ = asynqInspector.Close()
+		_ = st.Close()
+	}
+
+	var queues []string
+	for priority := range ripper.Priorities {
+		queues = append(queues, ripper.QueueName(priority), ripper.TrackQueueName(priority))
+	}
 
-	for i := range len(config.Wrappers) {
+	for _, queue := range queues {
 		task, err := ripper.NewInitQueueTask()
 		if err != nil {
-			logger.Error().Err(err).Msg(err.Error())
+			closeAll()
+			return nil, nil, nil, err
 		}
-		_, err = asynqClient.Enqueue(task, asynq.Queue(fmt.Sprintf("%v", i)))
+		_, err = asynqClient.Enqueue(task, asynq.Queue(queue))
 		if err != nil {
-			logger.Error().Err(err).Msg(err.Error())
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("failed to initialize queue %s: %w", queue, err)
 		}
-		msg := fmt.Sprintf("Queue %d initialized...", i)
+		msg := fmt.Sprintf("Queue %s initialized...", queue)
 		logger.Info().Msg(msg)
-		_, err = asynqInspector.DeleteAllCompletedTasks(fmt.Sprintf("%v", i))
-		if err != nil {
-			logger.Error().Err(err).Msg(err.Error())
-			return nil, nil
-		}
 	}
 
-	e := createEcho(config, logger.With().Logger(), asynqClient, asynqInspector)
+	e := createEcho(config, logger.With().Logger(), asynqClient, asynqInspector, st, auditLog)
 
 	listenAddr := fmt.Sprintf("%s:%d", config.Address, config.Port)
 
@@ -126,5 +185,5 @@ func CreateEchoWithServer(ctx context.Context, config *Config) (*echo.Echo, *htt
 		BaseContext: func(l net.Listener) context.Context { return ctx },
 	}
 
-	return e, srv
+	return e, srv, closeAll, nil
 }
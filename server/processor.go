@@ -3,18 +3,25 @@ package server
 import (
 	"archive/zip"
 	"compress/flate"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"io"
 	"io/fs"
+	"mime"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"ripper-api/ripper"
+	"ripper-api/store"
 
 	"github.com/hibiken/asynq"
 )
@@ -66,6 +73,12 @@ func writeZip(path fs.FS, oWriter io.Writer) error {
 	return nil
 }
 
+// claimTTL keeps a task ID bound to its queue for a while after the task itself expired
+const claimTTL = 24 * time.Hour
+
+// errPartial is what callers that set failOnPartial get for partial results
+var errPartial = errors.New("some tracks could not be ripped")
+
 func returnError(err error, c echo.Context) error {
 	msg := &Message{
 		Msg: err.Error(),
@@ -99,7 +112,10 @@ func ProcessLink(c echo.Context) error {
 		return err
 	}
 
-	storefront, albumId := checkUrl(url.Url)
+	storefront, albumId := strings.ToLower(url.Storefront), url.Id
+	if url.Url != "" {
+		storefront, albumId = checkUrl(url.Url)
+	}
 
 	if storefront == "" && albumId == "" {
 		msg := &Message{
@@ -108,34 +124,304 @@ func ProcessLink(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, msg)
 	}
 
-	insp := cc.Inspector
-	minTasks := 100
-	var queuename int
-	for i := range len(cc.Wrappers) {
-		info, err := insp.GetQueueInfo(fmt.Sprintf("%v", i))
-		if err != nil {
-			c.Logger().Errorf("failed to get queue info: %v", err)
+	event := auditEvent(c)
+	event.AlbumId, event.Storefront = albumId, storefront
+
+	opts := ripper.RipOptions{
+		Language:       url.Language,
+		MetaStorefront: strings.ToLower(url.MetaStorefront),
+		Tracks:         normalizeTracks(url.Tracks),
+	}
+	if opts.MetaStorefront == storefront {
+		opts.MetaStorefront = ""
+	}
+
+	limits, err := jobLimits(cc.Config, url)
+	if err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	key := ripper.ResultKey(storefront, albumId, opts)
+
+	cached, err := cachedResult(cc, key)
+	if err != nil {
+		c.Logger().Errorf("failed to look up cache: %v", err)
+		return returnError(err, c)
+	}
+	// partial results are ripped again, which picks up the missing tracks, unless none of them could be had
+	if cached != nil && (!cached.Partial || !ripper.Retryable(cached.FailureKinds)) {
+		// the answer is a job like any other, so the result is kept for its retention
+		if err := cc.Store.HoldResult(c.Request().Context(), key, CacheQueue, time.Now().Add(limits.retention)); err != nil {
+			c.Logger().Errorf("failed to hold result: %v", err)
 			return returnError(err, c)
 		}
+		event.JobId, event.QueueId, event.Outcome = key, CacheQueue, "cached"
+		recordSubmission(c, key, url.Url, event.Outcome)
+		return c.JSON(http.StatusOK, JobQuery{JobId: key, QueueId: CacheQueue, FailOnPartial: url.FailOnPartial})
+	}
 
-		if info.Active < minTasks {
-			queuename = i
-			minTasks = info.Active
+	priority := url.Priority
+	if priority == "" {
+		priority = ripper.PriorityNormal
+	}
+	if priority == ripper.PriorityHigh && !slices.Contains(cc.PriorityKeys, c.Request().Header.Get("Api-Key")) {
+		msg := &Message{
+			Msg: "High priority is not available for this key",
 		}
+		return c.JSON(http.StatusForbidden, msg)
 	}
 
-	task, err := ripper.NewRipTask(storefront, albumId, cc.Config.WebDir, cc.Wrappers[queuename])
+	insp := cc.Inspector
+
+	taskId := key
+
+	// the first submission decides the queue, later ones are pointed at the same job.
+	// A higher priority moves the job along as long as it hasn't started
+	wanted := ripper.QueueName(priority)
+	queue, err := cc.Store.ClaimTask(c.Request().Context(), taskId, wanted, limits.retention+claimTTL)
+	if err != nil {
+		c.Logger().Errorf("failed to claim task: %v", err)
+		return returnError(err, c)
+	}
+
+	existing, err := insp.GetTaskInfo(queue, taskId)
+	if err == nil {
+		// results worth keeping were answered from the cache above, so a completed job here is partial or evicted
+		retry := existing.State == asynq.TaskStateArchived || existing.State == asynq.TaskStateCompleted
+		if !retry {
+			if ripper.Outranks(priority, ripper.PriorityOf(queue)) && existing.State != asynq.TaskStateActive {
+				moved, err := moveTask(cc, existing, wanted, limits.retention+claimTTL)
+				if err != nil {
+					c.Logger().Errorf("failed to move task: %v", err)
+					return returnError(err, c)
+				}
+				if moved != nil {
+					existing = moved
+				}
+			}
+			event.JobId, event.QueueId, event.Outcome = existing.ID, existing.Queue, "duplicate"
+			recordSubmission(c, existing.ID, url.Url, event.Outcome)
+			return c.JSON(http.StatusAccepted, JobQuery{JobId: existing.ID, QueueId: existing.Queue, FailOnPartial: url.FailOnPartial})
+		}
+		// failed, partial and evicted jobs are not worth sharing, start over
+		if err := insp.DeleteTask(queue, taskId); err != nil {
+			c.Logger().Errorf("failed to delete finished task: %v", err)
+			return returnError(err, c)
+		}
+	}
+	// a new run goes to the queue of the submission that starts it
+	if queue != wanted {
+		if ok, err := cc.Store.MoveClaim(c.Request().Context(), taskId, queue, wanted, limits.retention+claimTTL); err != nil {
+			c.Logger().Errorf("failed to claim task: %v", err)
+			return returnError(err, c)
+		} else if !ok {
+			// someone else started it in the meantime
+			event.JobId, event.QueueId, event.Outcome = taskId, queue, "duplicate"
+			recordSubmission(c, taskId, url.Url, event.Outcome)
+			return c.JSON(http.StatusAccepted, JobQuery{JobId: taskId, QueueId: queue, FailOnPartial: url.FailOnPartial})
+		}
+		queue = wanted
+	}
+
+	submittedAt := time.Now().UTC()
+	task, err := ripper.NewRipTask(storefront, albumId, cc.Config.WebDir, opts, limits.retention, limits.resultTTL, submittedAt)
 	if err != nil {
 		c.Logger().Errorf("failed to create new rip task: %v", err)
 		return returnError(err, c)
 	}
 
-	info, err := cc.Client.Enqueue(task, asynq.Retention(time.Hour), asynq.Queue(fmt.Sprintf("%v", queuename)))
+	info, err := cc.Client.Enqueue(task, append(limits.options(), asynq.TaskID(taskId), asynq.Queue(queue))...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		// someone enqueued the same album in the meantime, the record is theirs
+		event.JobId, event.QueueId, event.Outcome = taskId, queue, "duplicate"
+		recordSubmission(c, taskId, url.Url, event.Outcome)
+		return c.JSON(http.StatusAccepted, JobQuery{JobId: taskId, QueueId: queue, FailOnPartial: url.FailOnPartial})
+	}
 	if err != nil {
 		c.Logger().Errorf("failed to enqueue task: %v", err)
 		return returnError(err, c)
 	}
-	return c.JSON(http.StatusAccepted, JobQuery{JobId: info.ID, QueueId: info.Queue})
+
+	// the worker may have started already, its updates are merged into the record
+	options, _ := json.Marshal(opts)
+	record := &store.JobRecord{
+		JobId:       taskId,
+		QueueId:     queue,
+		Owner:       keyId(c.Request().Header.Get("Api-Key")),
+		Url:         url.Url,
+		AlbumId:     albumId,
+		Storefront:  storefront,
+		Options:     options,
+		Status:      ripper.JobPending,
+		SubmittedAt: submittedAt,
+	}
+	if err := cc.Store.CreateJob(c.Request().Context(), record, cc.JobHistory); err != nil {
+		c.Logger().Errorf("failed to record job: %v", err)
+	}
+	event.JobId, event.QueueId, event.Outcome = info.ID, info.Queue, "queued"
+	recordSubmission(c, info.ID, url.Url, event.Outcome)
+	return c.JSON(http.StatusAccepted, JobQuery{JobId: info.ID, QueueId: info.Queue, FailOnPartial: url.FailOnPartial})
+}
+
+// moveTask moves a task that hasn't started to another queue. It returns nil if the task started in the meantime
+// or was moved by someone else, it stays where it is then
+func moveTask(cc *ConfigContext, info *asynq.TaskInfo, queue string, ttl time.Duration) (*asynq.TaskInfo, error) {
+	ctx := cc.Request().Context()
+
+	// claiming the new queue first keeps concurrent submissions from starting the job there
+	if moved, err := cc.Store.MoveClaim(ctx, info.ID, info.Queue, queue, ttl); err != nil || !moved {
+		return nil, err
+	}
+	if err := cc.Inspector.DeleteTask(info.Queue, info.ID); err != nil {
+		cc.Logger().Infof("task %v not moved: %v", info.ID, err)
+		_, err = cc.Store.MoveClaim(ctx, info.ID, queue, info.Queue, ttl)
+		return nil, err
+	}
+
+	// the attempts it already made still count
+	opts := []asynq.Option{
+		asynq.TaskID(info.ID),
+		asynq.Retention(info.Retention),
+		asynq.MaxRetry(max(info.MaxRetry-info.Retried, 0)),
+	}
+	if info.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(info.Timeout))
+	}
+	if !info.Deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(info.Deadline))
+	}
+	moved, err := cc.Client.Enqueue(asynq.NewTask(info.Type, info.Payload), append(opts, asynq.Queue(queue))...)
+	if err != nil {
+		// put it back rather than losing it
+		_, _ = cc.Store.MoveClaim(ctx, info.ID, queue, info.Queue, ttl)
+		if _, err := cc.Client.Enqueue(asynq.NewTask(info.Type, info.Payload), append(opts, asynq.Queue(info.Queue))...); err != nil {
+			cc.Logger().Errorf("failed to put back task %v: %v", info.ID, err)
+		}
+		return nil, err
+	}
+
+	var payload ripper.RipPayload
+	if err := json.Unmarshal(info.Payload, &payload); err == nil {
+		if err := cc.Store.JobMoved(ctx, info.ID, payload.SubmittedAt, queue); err != nil {
+			cc.Logger().Errorf("failed to record job: %v", err)
+		}
+	}
+	return moved, nil
+}
+
+// recordSubmission adds the submission to the history of the job it was answered with
+func recordSubmission(c echo.Context, jobId string, url string, outcome string) {
+	cc := c.(*ConfigContext)
+
+	submission := store.Submission{
+		Owner:       keyId(c.Request().Header.Get("Api-Key")),
+		Url:         url,
+		SubmittedAt: time.Now().UTC(),
+		Outcome:     outcome,
+	}
+	if err := cc.Store.AddSubmission(c.Request().Context(), jobId, submission, cc.JobHistory); err != nil {
+		c.Logger().Errorf("failed to record submission: %v", err)
+	}
+}
+
+type jobSettings struct {
+	retention time.Duration
+	resultTTL time.Duration
+	timeout   time.Duration
+	deadline  time.Time
+	maxRetry  int
+}
+
+func (s *jobSettings) options() []asynq.Option {
+	opts := []asynq.Option{asynq.Retention(s.retention), asynq.MaxRetry(s.maxRetry)}
+	if s.timeout > 0 {
+		opts = append(opts, asynq.Timeout(s.timeout))
+	}
+	if !s.deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(s.deadline))
+	}
+	return opts
+}
+
+// jobLimits applies the overrides of the submission to the configured defaults, rejecting the ones above the limits
+func jobLimits(config *Config, url *SubmittedUrl) (*jobSettings, error) {
+	settings := &jobSettings{
+		retention: config.Retention,
+		resultTTL: config.ResultTTL,
+		timeout:   config.Timeout,
+		maxRetry:  config.MaxRetry,
+	}
+
+	override := func(name string, value string, limit time.Duration, target *time.Duration) error {
+		if value == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %v", name, value)
+		}
+		if limit > 0 && d > limit {
+			return fmt.Errorf("%s %v exceeds the limit of %v", name, d, limit)
+		}
+		*target = d
+		return nil
+	}
+
+	if err := override("retention", url.Retention, config.MaxRetention, &settings.retention); err != nil {
+		return nil, err
+	}
+	if err := override("resultTtl", url.ResultTTL, config.MaxResultTTL, &settings.resultTTL); err != nil {
+		return nil, err
+	}
+	if err := override("timeout", url.Timeout, config.MaxTimeout, &settings.timeout); err != nil {
+		return nil, err
+	}
+
+	if url.Deadline != nil {
+		if !url.Deadline.After(time.Now()) {
+			return nil, fmt.Errorf("deadline %v has already passed", url.Deadline)
+		}
+		if config.MaxTimeout > 0 && time.Until(*url.Deadline) > config.MaxTimeout {
+			return nil, fmt.Errorf("deadline %v is further away than the limit of %v", url.Deadline, config.MaxTimeout)
+		}
+		settings.deadline = *url.Deadline
+	}
+
+	if url.MaxRetry != nil {
+		if *url.MaxRetry > config.MaxRetryLimit {
+			return nil, fmt.Errorf("maxRetry %d exceeds the limit of %d", *url.MaxRetry, config.MaxRetryLimit)
+		}
+		settings.maxRetry = *url.MaxRetry
+	}
+
+	return settings, nil
+}
+
+// normalizeTracks sorts and deduplicates the selection, so equal selections share a result
+func normalizeTracks(tracks []string) []string {
+	if len(tracks) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(tracks)
+	for i, sel := range sorted {
+		// "#03" and "#3" are the same track, song IDs don't start with zeros
+		if position, ok := strings.CutPrefix(sel, "#"); ok {
+			p, _ := strconv.Atoi(position)
+			sorted[i] = "#" + strconv.Itoa(p)
+		} else if disc, track, found := strings.Cut(sel, ":"); found {
+			d, _ := strconv.Atoi(disc)
+			t, _ := strconv.Atoi(track)
+			sorted[i] = fmt.Sprintf("%d:%d", d, t)
+		} else {
+			id, _ := strconv.Atoi(sel)
+			sorted[i] = strconv.Itoa(id)
+		}
+	}
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
 }
 
 func ProcessRequestID(c echo.Context) error {
@@ -154,51 +440,226 @@ func ProcessRequestID(c echo.Context) error {
 		return err
 	}
 
-	insp := cc.Inspector
+	event := auditEvent(c)
+	event.JobId, event.QueueId = job.JobId, job.QueueId
 
-	info, err := insp.GetTaskInfo(job.QueueId, job.JobId)
+	if job.QueueId == CacheQueue {
+		entry, err := cachedResult(cc, job.JobId)
+		if err != nil {
+			c.Logger().Errorf("failed to look up cache: %v", err)
+			return returnError(err, c)
+		}
+		if entry == nil {
+			event.Outcome = "gone"
+			return c.JSON(http.StatusGone, &Message{Msg: "result is no longer cached"})
+		}
+		event.AlbumId, event.Storefront = entry.AlbumId, entry.Storefront
+		return serveResult(c, job, entry)
+	}
+
+	info, err := taskInfo(cc, job)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		event.Outcome = "expired"
+		return expiredJob(c, job)
+	}
 	if err != nil {
 		c.Logger().Errorf("failed to get task info: %v", err)
 		return returnError(err, c)
 	}
 
+	var payload ripper.RipPayload
+	if err := json.Unmarshal(info.Payload, &payload); err == nil {
+		event.AlbumId, event.Storefront = payload.AlbumId, payload.Storefront
+	}
+
 	switch info.State {
 	case 1:
+		event.Outcome = "running"
 		return c.NoContent(http.StatusNoContent)
 
 	case 2, 3, 7:
+		event.Outcome = "pending"
 		return c.NoContent(http.StatusCreated)
 
 	case 6:
-		task, err := ripper.NewDeleteTask(string(info.Result))
+		entry, err := cachedResult(cc, info.ID)
 		if err != nil {
-			c.Logger().Errorf("failed to create new delete task: %v", err)
+			c.Logger().Errorf("failed to look up cache: %v", err)
 			return returnError(err, c)
 		}
+		if entry == nil {
+			event.Outcome = "gone"
+			return c.JSON(http.StatusGone, &Message{Msg: "result has been evicted from the cache"})
+		}
+		return serveResult(c, job, entry)
 
-		_, err = cc.Client.Enqueue(task, asynq.Queue(info.Queue), asynq.ProcessIn(time.Hour))
+	default:
+		err = errors.New(info.LastErr)
+		c.Logger().Errorf("error: %v", err)
+		return returnError(err, c)
+	}
+}
+
+// JobReport tells how a job is doing, and once it's done, how every track went
+func JobReport(c echo.Context) error {
+	cc := c.(*ConfigContext)
+
+	job := new(JobQuery)
+
+	if err := c.Bind(job); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(job); err != nil {
+		return err
+	}
+
+	status := &JobStatus{JobId: job.JobId, QueueId: job.QueueId}
+
+	if job.QueueId == CacheQueue {
+		entry, err := cc.Store.CacheGet(c.Request().Context(), job.JobId)
 		if err != nil {
-			c.Logger().Errorf("failed to enqueue delete task: %v", err)
+			c.Logger().Errorf("failed to look up cache: %v", err)
 			return returnError(err, c)
 		}
+		if entry == nil {
+			return c.JSON(http.StatusGone, &Message{Msg: "result is no longer cached"})
+		}
+		status.Status = StatusCompleted
+		if entry.Partial {
+			status.Status = StatusPartial
+		}
+		failOnPartial(job, status)
+		return c.JSON(http.StatusOK, status)
+	}
 
-		pr, pw := io.Pipe()
-		go func() {
-			if err := writeZip(os.DirFS(string(info.Result)), pw); err != nil {
-				c.Logger().Errorf("error on writing zip: %v", err)
-			}
+	info, err := taskInfo(cc, job)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return expiredJob(c, job)
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to get task info: %v", err)
+		return returnError(err, c)
+	}
+	status.QueueId = info.Queue
 
-			if err := pw.Close(); err != nil {
-				c.Logger().Errorf("error on closing zip writer: %v", err)
-			}
-		}()
+	if len(info.Result) > 0 {
+		if status.Result, err = ripper.ParseRipResult(info.Result); err != nil {
+			c.Logger().Errorf("failed to read job result: %v", err)
+			return returnError(err, c)
+		}
+	}
+
+	switch info.State {
+	case asynq.TaskStateActive:
+		status.Status = StatusRunning
+	case asynq.TaskStatePending, asynq.TaskStateScheduled, asynq.TaskStateAggregating:
+		status.Status = StatusPending
+	case asynq.TaskStateRetry:
+		status.Status, status.Error = StatusRetrying, info.LastErr
+	case asynq.TaskStateArchived:
+		status.Status, status.Error = StatusFailed, info.LastErr
+	case asynq.TaskStateCompleted:
+		status.Status = StatusCompleted
+		if status.Result != nil && status.Result.Partial {
+			status.Status = StatusPartial
+		}
+	}
+	failOnPartial(job, status)
+	return c.JSON(http.StatusOK, status)
+}
 
-		return StreamConnWrapper(c, http.StatusOK, "application/zip", pr)
+// failOnPartial reports a partial job as failed to callers that asked for it
+func failOnPartial(job *JobQuery, status *JobStatus) {
+	if job.FailOnPartial && status.Status == StatusPartial {
+		status.Status, status.Error = StatusFailed, errPartial.Error()
+	}
+}
 
-	default:
-		c.Logger().Errorf("error: %v", err)
+// taskInfo looks the job up in its queue, following it to the queue it was moved to by a higher priority
+func taskInfo(cc *ConfigContext, job *JobQuery) (*asynq.TaskInfo, error) {
+	info, err := cc.Inspector.GetTaskInfo(job.QueueId, job.JobId)
+	if !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound) {
+		return info, err
+	}
+	queue, claimErr := cc.Store.ClaimedQueue(cc.Request().Context(), job.JobId)
+	if claimErr != nil || queue == "" || queue == job.QueueId {
+		return info, err
+	}
+	return cc.Inspector.GetTaskInfo(queue, job.JobId)
+}
+
+// expiredJob answers queries for jobs asynq no longer knows about with their history, if there is any
+func expiredJob(c echo.Context, job *JobQuery) error {
+	cc := c.(*ConfigContext)
+
+	record, err := cc.Store.GetJob(c.Request().Context(), job.JobId)
+	if err != nil {
+		c.Logger().Errorf("failed to get job history: %v", err)
 		return returnError(err, c)
 	}
+	if record == nil {
+		return c.JSON(http.StatusNotFound, &Message{Msg: "unknown job"})
+	}
+	return c.JSON(http.StatusGone, &JobStatus{
+		JobId:   job.JobId,
+		QueueId: job.QueueId,
+		Status:  StatusExpired,
+		History: record,
+	})
+}
+
+// cachedResult returns the cache entry for the key and marks it as used, or nil if it's not cached
+func cachedResult(cc *ConfigContext, key string) (*store.CacheEntry, error) {
+	ctx := cc.Request().Context()
+
+	entry, err := cc.Store.CacheGet(ctx, key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(entry.Folder); os.IsNotExist(err) {
+		_, err = cc.Store.CacheDrop(ctx, entry)
+		return nil, err
+	}
+
+	return entry, cc.Store.CacheTouch(ctx, key)
+}
+
+// serveResult streams the cached result, unless it's partial and the caller asked to fail on partial results
+func serveResult(c echo.Context, job *JobQuery, entry *store.CacheEntry) error {
+	event := auditEvent(c)
+
+	if entry.Partial {
+		if job.FailOnPartial {
+			event.Outcome = "failed"
+			return returnError(errPartial, c)
+		}
+		c.Response().Header().Set(HeaderRipStatus, StatusPartial)
+	}
+	event.Outcome = "served"
+	return streamResult(c, entry.Folder)
+}
+
+func streamResult(c echo.Context, folder string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		if err := writeZip(os.DirFS(folder), pw); err != nil {
+			c.Logger().Errorf("error on writing zip: %v", err)
+		}
+
+		if err := pw.Close(); err != nil {
+			c.Logger().Errorf("error on closing zip writer: %v", err)
+		}
+	}()
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+		"filename": filepath.Base(folder) + ".zip",
+	}))
+	return StreamConnWrapper(c, http.StatusOK, "application/zip", pr)
 }
 
 func StreamConnWrapper(c echo.Context, status int, contentType string, r io.Reader) error {
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTracks(t *testing.T) {
+	tests := []struct {
+		name   string
+		tracks []string
+		want   []string
+	}{
+		{name: "none", tracks: nil, want: nil},
+		{name: "empty", tracks: []string{}, want: nil},
+		{name: "leading zeros", tracks: []string{"#03", "2:05", "01:1"}, want: []string{"#3", "1:1", "2:5"}},
+		{name: "duplicates", tracks: []string{"#3", "#03", "1440833098", "1440833098"}, want: []string{"#3", "1440833098"}},
+		{name: "sorted", tracks: []string{"2:1", "1440833098", "#10", "#2"}, want: []string{"#10", "#2", "1440833098", "2:1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeTracks(tt.tracks); !slices.Equal(got, tt.want) {
+				t.Errorf("normalizeTracks(%v) = %v, want %v", tt.tracks, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobLimits(t *testing.T) {
+	config := &Config{
+		Retention:     time.Hour,
+		MaxRetention:  24 * time.Hour,
+		ResultTTL:     0,
+		MaxResultTTL:  48 * time.Hour,
+		Timeout:       30 * time.Minute,
+		MaxTimeout:    2 * time.Hour,
+		MaxRetry:      3,
+		MaxRetryLimit: 10,
+	}
+	ptr := func(n int) *int { return &n }
+	at := func(d time.Duration) *time.Time {
+		deadline := time.Now().Add(d)
+		return &deadline
+	}
+
+	tests := []struct {
+		name    string
+		url     SubmittedUrl
+		want    jobSettings
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: jobSettings{retention: time.Hour, timeout: 30 * time.Minute, maxRetry: 3},
+		},
+		{
+			name: "overrides",
+			url:  SubmittedUrl{Retention: "2h", ResultTTL: "90m", Timeout: "1h", MaxRetry: ptr(0)},
+			want: jobSettings{retention: 2 * time.Hour, resultTTL: 90 * time.Minute, timeout: time.Hour, maxRetry: 0},
+		},
+		{
+			name: "at the limits",
+			url:  SubmittedUrl{Retention: "24h", ResultTTL: "48h", Timeout: "2h", MaxRetry: ptr(10)},
+			want: jobSettings{retention: 24 * time.Hour, resultTTL: 48 * time.Hour, timeout: 2 * time.Hour, maxRetry: 10},
+		},
+		{name: "retention above limit", url: SubmittedUrl{Retention: "25h"}, wantErr: true},
+		{name: "result ttl above limit", url: SubmittedUrl{ResultTTL: "49h"}, wantErr: true},
+		{name: "timeout above limit", url: SubmittedUrl{Timeout: "3h"}, wantErr: true},
+		{name: "invalid duration", url: SubmittedUrl{Retention: "soon"}, wantErr: true},
+		{name: "negative duration", url: SubmittedUrl{Timeout: "-1h"}, wantErr: true},
+		{name: "zero duration", url: SubmittedUrl{ResultTTL: "0s"}, wantErr: true},
+		{name: "max retry above limit", url: SubmittedUrl{MaxRetry: ptr(11)}, wantErr: true},
+		{name: "past deadline", url: SubmittedUrl{Deadline: at(-time.Minute)}, wantErr: true},
+		{name: "deadline beyond max timeout", url: SubmittedUrl{Deadline: at(3 * time.Hour)}, wantErr: true},
+		{
+			name: "deadline",
+			url:  SubmittedUrl{Deadline: at(time.Hour)},
+			want: jobSettings{retention: time.Hour, timeout: 30 * time.Minute, maxRetry: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jobLimits(config, &tt.url)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("jobLimits() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("jobLimits() failed: %v", err)
+			}
+
+			want := tt.want
+			if tt.url.Deadline != nil {
+				want.deadline = *tt.url.Deadline
+			}
+			if *got != want {
+				t.Errorf("jobLimits() = %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
@@ -1,19 +1,98 @@
 package server
 
 import (
+	"time"
+
+	"ripper-api/audit"
+	"ripper-api/ripper"
+	"ripper-api/store"
+
 	"github.com/go-playground/validator"
 	"github.com/hibiken/asynq"
 	"github.com/labstack/echo/v4"
 )
 
+// HeaderRipStatus is set to StatusPartial on downloads of results that miss some tracks
+const HeaderRipStatus = "Rip-Status"
+
+// Job statuses reported by JobReport
+const (
+	StatusPending   = ripper.JobPending
+	StatusRunning   = ripper.JobRunning
+	StatusRetrying  = ripper.JobRetrying
+	StatusFailed    = ripper.JobFailed
+	StatusCompleted = ripper.JobCompleted
+	StatusPartial   = ripper.JobPartial
+	// StatusExpired jobs are only known from their history
+	StatusExpired = "expired"
+)
+
+// CacheQueue is reported as the queue of jobs answered straight from the result cache
+const CacheQueue = "cache"
+
 type Config struct {
-	Port         uint
-	Address      string
-	AddressRedis string
-	Wrappers     []string
-	WebDir       string
-	RedisPw      string
-	KeyList      []string
+	Port     uint
+	Address  string
+	Redis    asynq.RedisConnOpt
+	Backend  string
+	DataFile string
+	Wrappers map[string]store.Wrapper
+	WebDir   string
+	KeyList  []string
+
+	// CacheSize is the disk budget for cached results in MiB
+	CacheSize uint
+	// OrphanTTL is how long unreferenced result folders are kept
+	OrphanTTL time.Duration
+	// CollectInterval is the time between orphan collector runs
+	CollectInterval time.Duration
+	// ApiUrl is the base URL of the catalog API
+	ApiUrl string
+	// WebPlayerUrl is the web player the developer token is scraped from
+	WebPlayerUrl string
+	// PriorityKeys may submit high priority jobs
+	PriorityKeys []string
+	// StrictPriority drains higher priority queues before looking at lower ones
+	StrictPriority bool
+	// QueueWeights overrides the weights of the priority queues
+	QueueWeights map[string]int
+
+	// Retention is how long finished jobs can be queried
+	Retention    time.Duration
+	MaxRetention time.Duration
+	// ResultTTL is how long results are kept after their last download, 0 until they get evicted
+	ResultTTL    time.Duration
+	MaxResultTTL time.Duration
+	// Timeout is how long a rip may run, 0 for asynq's default
+	Timeout    time.Duration
+	MaxTimeout time.Duration
+	// MaxRetry is how often a failed rip is retried
+	MaxRetry      int
+	MaxRetryLimit int
+
+	// IdempotencyWindow is how long responses are kept for replays of an Idempotency-Key
+	IdempotencyWindow time.Duration
+	// JobHistory is how long job records are kept, 0 keeps them forever
+	JobHistory time.Duration
+	// ShutdownTimeout is how long running rips and downloads may take to finish on shutdown
+	ShutdownTimeout time.Duration
+
+	// AdminKeys may use the /admin/ endpoints
+	AdminKeys []string
+	// AuditLog is the file audit events are appended to, empty to disable it
+	AuditLog string
+	// AuditStream also writes audit events to a Redis stream
+	AuditStream bool
+
+	// ProbeInterval is the time between wrapper health probes, ProbeTimeout bounds a single probe
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// QuarantineAfter is the number of failed probes in a row that quarantine a wrapper
+	QuarantineAfter int
+
+	// LogFormat is console or json, LogLevel the minimum level that gets logged
+	LogFormat string
+	LogLevel  string
 }
 
 type ConfigContext struct {
@@ -21,16 +100,168 @@ type ConfigContext struct {
 	*Config
 	*asynq.Client
 	*asynq.Inspector
+	*store.Store
+	Audit *audit.Log
 }
 
 type (
 	JobQuery struct {
 		JobId   string `json:"jobid" validate:"required"`
 		QueueId string `json:"queueid" validate:"required"`
+		// FailOnPartial reports partial results as failed to this caller, jobs are shared by callers with either setting
+		FailOnPartial bool `json:"failOnPartial,omitempty"`
 	}
 
+	// SubmittedUrl takes either an album URL or an album ID with its storefront
 	SubmittedUrl struct {
-		Url string `json:"url" validate:"required"`
+		Url        string `json:"url,omitempty" validate:"required_without=Id"`
+		Id         string `json:"id,omitempty" validate:"required_without=Url,omitempty,numeric"`
+		Storefront string `json:"storefront,omitempty" validate:"required_with=Id,omitempty,len=2,alpha"`
+		// Language and MetaStorefront change the metadata used for tags and folder names
+		Language       string `json:"language,omitempty" validate:"omitempty,language"`
+		MetaStorefront string `json:"metadataStorefront,omitempty" validate:"omitempty,len=2,alpha"`
+		// Tracks picks tracks by album position ("#3", 1-based across discs), disc and track number ("2:5") or song ID
+		Tracks []string `json:"tracks,omitempty" validate:"omitempty,dive,track"`
+		// Priority is one of high, normal and low, high is reserved for PriorityKeys
+		Priority string `json:"priority,omitempty" validate:"omitempty,oneof=high normal low"`
+		// Retention, ResultTTL and Timeout are durations like "90m", bounded by the configured limits
+		Retention string     `json:"retention,omitempty"`
+		ResultTTL string     `json:"resultTtl,omitempty"`
+		Timeout   string     `json:"timeout,omitempty"`
+		Deadline  *time.Time `json:"deadline,omitempty"`
+		MaxRetry  *int       `json:"maxRetry,omitempty" validate:"omitempty,min=0"`
+		// FailOnPartial is echoed in the JobQuery, which reports a partial result as failed then
+		FailOnPartial bool `json:"failOnPartial,omitempty"`
+	}
+
+	// JobStatus is the state of a job with the report of its tracks, which is only there once it's done
+	JobStatus struct {
+		JobId   string            `json:"jobid"`
+		QueueId string            `json:"queueid"`
+		Status  string            `json:"status"`
+		Error   string            `json:"error,omitempty"`
+		Result  *ripper.RipResult `json:"result,omitempty"`
+		History *store.JobRecord  `json:"history,omitempty"`
+	}
+
+	// AuditQuery selects audit events by key ID and time range, times are RFC 3339
+	AuditQuery struct {
+		Key   string     `query:"key"`
+		From  *time.Time `query:"from"`
+		To    *time.Time `query:"to"`
+		Limit int        `query:"limit" validate:"min=0,max=10000"`
+	}
+
+	// WrapperRequest names a wrapper for the admin API, Slots and Weight default to 1.
+	// Labels are the priorities the wrapper is reserved for
+	WrapperRequest struct {
+		Address string   `json:"address" validate:"required,hostport"`
+		Slots   int      `json:"slots,omitempty" validate:"min=0"`
+		Weight  int      `json:"weight,omitempty" validate:"min=0"`
+		Labels  []string `json:"labels,omitempty" validate:"dive,oneof=high normal low"`
+	}
+
+	// WrapperStatus is a pooled wrapper as reported by the admin API. Health is unknown until the first probe
+	WrapperStatus struct {
+		Address     string     `json:"address"`
+		Slots       int        `json:"slots"`
+		Weight      int        `json:"weight"`
+		Labels      []string   `json:"labels,omitempty"`
+		Leased      int        `json:"leased"`
+		Draining    bool       `json:"draining"`
+		Healthy     bool       `json:"healthy"`
+		Quarantined bool       `json:"quarantined"`
+		Failures    int        `json:"failures"`
+		CheckedAt   *time.Time `json:"checkedAt,omitempty"`
+		Error       string     `json:"error,omitempty"`
+	}
+
+	PreviewQuery struct {
+		Url            string `query:"url" json:"url" validate:"required"`
+		Language       string `query:"language" json:"language" validate:"omitempty,language"`
+		MetaStorefront string `query:"metadataStorefront" json:"metadataStorefront" validate:"omitempty,len=2,alpha"`
+	}
+
+	AlbumPreview struct {
+		Id          string         `json:"id"`
+		Title       string         `json:"title"`
+		Artist      string         `json:"artist"`
+		Label       string         `json:"label"`
+		Upc         string         `json:"upc"`
+		ReleaseDate string         `json:"releaseDate"`
+		Copyright   string         `json:"copyright"`
+		Genres      []string       `json:"genres"`
+		AudioTraits []string       `json:"audioTraits"`
+		Artwork     string         `json:"artwork"`
+		TrackCount  int            `json:"trackCount"`
+		DurationMs  int            `json:"durationMs"`
+		Duration    string         `json:"duration"`
+		Tracks      []TrackPreview `json:"tracks"`
+	}
+
+	TrackPreview struct {
+		Position    int      `json:"position"`
+		Disc        int      `json:"disc"`
+		TrackNumber int      `json:"trackNumber"`
+		Id          string   `json:"id"`
+		Title       string   `json:"title"`
+		Artist      string   `json:"artist"`
+		Composer    string   `json:"composer"`
+		DurationMs  int      `json:"durationMs"`
+		Duration    string   `json:"duration"`
+		Isrc        string   `json:"isrc"`
+		AudioTraits []string `json:"audioTraits"`
+	}
+
+	SearchQuery struct {
+		Term       string `query:"term" validate:"required"`
+		Storefront string `query:"storefront" validate:"required,len=2,alpha"`
+		Types      string `query:"types"`
+		Limit      int    `query:"limit" validate:"min=0,max=25"`
+	}
+
+	SearchResults struct {
+		Albums  []SearchAlbum  `json:"albums"`
+		Songs   []SearchSong   `json:"songs"`
+		Artists []SearchArtist `json:"artists"`
+	}
+
+	SearchAlbum struct {
+		Id          string       `json:"id"`
+		Title       string       `json:"title"`
+		Artist      string       `json:"artist"`
+		ReleaseDate string       `json:"releaseDate"`
+		TrackCount  int          `json:"trackCount"`
+		IsSingle    bool         `json:"isSingle"`
+		AudioTraits []string     `json:"audioTraits"`
+		Artwork     string       `json:"artwork"`
+		Url         string       `json:"url"`
+		Submit      SubmittedUrl `json:"submit"`
+	}
+
+	SearchSong struct {
+		Id          string       `json:"id"`
+		Title       string       `json:"title"`
+		Artist      string       `json:"artist"`
+		Album       string       `json:"album"`
+		AlbumId     string       `json:"albumId"`
+		Disc        int          `json:"disc"`
+		TrackNumber int          `json:"trackNumber"`
+		DurationMs  int          `json:"durationMs"`
+		Duration    string       `json:"duration"`
+		Isrc        string       `json:"isrc"`
+		AudioTraits []string     `json:"audioTraits"`
+		Artwork     string       `json:"artwork"`
+		Url         string       `json:"url"`
+		Submit      SubmittedUrl `json:"submit"`
+	}
+
+	SearchArtist struct {
+		Id      string   `json:"id"`
+		Name    string   `json:"name"`
+		Genres  []string `json:"genres"`
+		Artwork string   `json:"artwork"`
+		Url     string   `json:"url"`
 	}
 
 	CustomValidator struct {
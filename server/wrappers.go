@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+
+	"ripper-api/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ListWrappers reports the wrapper pool with the load and health of every wrapper
+func ListWrappers(c echo.Context) error {
+	cc := c.(*ConfigContext)
+	ctx := c.Request().Context()
+
+	pool, err := cc.Store.Wrappers(ctx)
+	if err != nil {
+		c.Logger().Errorf("failed to get wrappers: %v", err)
+		return returnError(err, c)
+	}
+
+	draining, err := cc.Store.DrainingWrappers(ctx)
+	if err != nil {
+		c.Logger().Errorf("failed to get draining wrappers: %v", err)
+		return returnError(err, c)
+	}
+
+	statuses := make([]WrapperStatus, 0, len(pool))
+	for addr, w := range pool {
+		leases, err := cc.Store.WrapperLeases(ctx, addr)
+		if err != nil {
+			c.Logger().Errorf("failed to get wrapper leases: %v", err)
+			return returnError(err, c)
+		}
+		health, err := cc.Store.WrapperHealth(ctx, addr)
+		if err != nil {
+			c.Logger().Errorf("failed to get wrapper health: %v", err)
+			return returnError(err, c)
+		}
+
+		status := WrapperStatus{
+			Address:  addr,
+			Slots:    w.Slots,
+			Weight:   w.Weight,
+			Labels:   w.Labels,
+			Leased:   len(leases),
+			Draining: slices.Contains(draining, addr),
+		}
+		if health != nil {
+			status.Healthy = health.Failures == 0
+			status.Quarantined = health.Quarantined
+			status.Failures = health.Failures
+			status.CheckedAt = &health.CheckedAt
+			status.Error = health.Error
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+
+	return c.JSON(http.StatusOK, statuses)
+}
+
+// AddWrapper adds a wrapper to the pool, or changes the settings of a pooled one
+func AddWrapper(c echo.Context) error {
+	cc := c.(*ConfigContext)
+
+	req := new(WrapperRequest)
+
+	if err := c.Bind(req); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	w := store.Wrapper{Slots: max(req.Slots, 1), Weight: max(req.Weight, 1), Labels: req.Labels}
+	if err := cc.Store.AddWrapper(c.Request().Context(), req.Address, w); err != nil {
+		c.Logger().Errorf("failed to add wrapper: %v", err)
+		return returnError(err, c)
+	}
+	return c.JSON(http.StatusOK, &Message{Msg: fmt.Sprintf("Wrapper %s added with %d slots", req.Address, w.Slots)})
+}
+
+// DrainWrapper lets a wrapper finish its rips without giving it new ones
+func DrainWrapper(c echo.Context) error {
+	cc := c.(*ConfigContext)
+
+	req := new(WrapperRequest)
+
+	if err := c.Bind(req); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	ok, err := cc.Store.DrainWrapper(c.Request().Context(), req.Address)
+	if err != nil {
+		c.Logger().Errorf("failed to drain wrapper: %v", err)
+		return returnError(err, c)
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, &Message{Msg: fmt.Sprintf("Wrapper %s is not in the pool", req.Address)})
+	}
+	return c.JSON(http.StatusOK, &Message{Msg: fmt.Sprintf("Wrapper %s is draining", req.Address)})
+}
+
+// RemoveWrapper drops a wrapper from the pool, rips running on it are not interrupted
+func RemoveWrapper(c echo.Context) error {
+	cc := c.(*ConfigContext)
+
+	req := new(WrapperRequest)
+
+	if err := c.Bind(req); err != nil {
+		msg := &Message{
+			Msg: err.Error(),
+		}
+		return c.JSON(http.StatusBadRequest, msg)
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	ok, err := cc.Store.RemoveWrapper(c.Request().Context(), req.Address)
+	if err != nil {
+		c.Logger().Errorf("failed to remove wrapper: %v", err)
+		return returnError(err, c)
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, &Message{Msg: fmt.Sprintf("Wrapper %s is not in the pool", req.Address)})
+	}
+	return c.JSON(http.StatusOK, &Message{Msg: fmt.Sprintf("Wrapper %s removed", req.Address)})
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// albumMetaKey holds the album metadata a rip shares with its track tasks
+func albumMetaKey(key string) string {
+	return KeyPrefix + "meta:" + key
+}
+
+// SetAlbumMeta keeps the metadata of the result for ttl
+func (s *Store) SetAlbumMeta(ctx context.Context, key string, meta []byte, ttl time.Duration) error {
+	return s.rdb.Set(ctx, albumMetaKey(key), meta, ttl).Err()
+}
+
+// AlbumMeta returns the metadata of the result, or nil if there is none
+func (s *Store) AlbumMeta(ctx context.Context, key string) ([]byte, error) {
+	meta, err := s.rdb.Get(ctx, albumMetaKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+// DropAlbumMeta removes the metadata of the result once its rip is done
+func (s *Store) DropAlbumMeta(ctx context.Context, key string) error {
+	return s.rdb.Del(ctx, albumMetaKey(key)).Err()
+}
+
+// trackReportKey maps the album positions of failed tracks to their reports
+func trackReportKey(jobId string) string {
+	return KeyPrefix + "tracks:" + jobId
+}
+
+// SetTrackReport records why a track of the job failed, for as long as ttl
+func (s *Store) SetTrackReport(ctx context.Context, jobId string, position int, report []byte, ttl time.Duration) error {
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, trackReportKey(jobId), position, report)
+	pipe.Expire(ctx, trackReportKey(jobId), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TrackReport returns the report of a failed track, or nil if there is none
+func (s *Store) TrackReport(ctx context.Context, jobId string, position int) ([]byte, error) {
+	report, err := s.rdb.HGet(ctx, trackReportKey(jobId), strconv.Itoa(position)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return report, err
+}
+
+// DropTrackReports removes the track reports of the job once they made it into its result
+func (s *Store) DropTrackReports(ctx context.Context, jobId string) error {
+	return s.rdb.Del(ctx, trackReportKey(jobId)).Err()
+}
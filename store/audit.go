@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// auditMaxLen caps the audit stream, older events are trimmed
+const auditMaxLen = 1_000_000
+
+func auditKey() string {
+	return KeyPrefix + "audit"
+}
+
+// AddAuditEvent appends an event to the audit stream. Stream IDs carry the time they were added,
+// which is what AuditEvents searches by
+func (s *Store) AddAuditEvent(ctx context.Context, event []byte) error {
+	return s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditKey(),
+		MaxLen: auditMaxLen,
+		Approx: true,
+		Values: []interface{}{"event", event},
+	}).Err()
+}
+
+// AuditEvents walks the audit stream from from to to, until fn returns false
+func (s *Store) AuditEvents(ctx context.Context, from time.Time, to time.Time, fn func(event []byte) (bool, error)) error {
+	const batch = 500
+
+	start := strconv.FormatInt(from.UnixMilli(), 10)
+	end := strconv.FormatInt(to.UnixMilli(), 10)
+	for {
+		msgs, err := s.rdb.XRangeN(ctx, auditKey(), start, end, batch).Result()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			event, _ := msg.Values["event"].(string)
+			more, err := fn([]byte(event))
+			if err != nil || !more {
+				return err
+			}
+		}
+		if len(msgs) < batch {
+			return nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type CacheEntry struct {
+	Key        string
+	Folder     string
+	Size       int64
+	AlbumId    string
+	Storefront string
+	// Partial is set for results that miss some of their tracks
+	Partial bool
+	// FailureKinds are the kinds of failure of the missing tracks, they tell whether ripping again could get them
+	FailureKinds []string
+	// TTL is how long the entry is kept after it was last used, 0 keeps it until it gets evicted
+	TTL time.Duration
+}
+
+// putEntry stores the entry and keeps the total cache size in sync when an entry gets replaced.
+// An entry shared by several jobs keeps the longest TTL any of them asked for
+var putEntry = redis.NewScript(`
+local old = tonumber(redis.call("HGET", KEYS[1], "size") or "0")
+local ttl = tonumber(redis.call("HGET", KEYS[1], "ttl") or "0")
+if ttl ~= 0 and (tonumber(ARGV[5]) == 0 or tonumber(ARGV[5]) > ttl) then
+	ttl = tonumber(ARGV[5])
+elseif redis.call("EXISTS", KEYS[1]) == 0 then
+	ttl = tonumber(ARGV[5])
+end
+redis.call("HSET", KEYS[1], "folder", ARGV[1], "size", ARGV[2], "ttl", ttl, "album", ARGV[6], "storefront", ARGV[7], "partial", ARGV[8], "kinds", ARGV[9])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[4])
+return redis.call("INCRBY", KEYS[3], tonumber(ARGV[2]) - old)
+`)
+
+// dropEntry removes the entry unless a hold on it is still running, returns 1 if it was removed
+var dropEntry = redis.NewScript(`
+if redis.call("ZCOUNT", KEYS[4], ARGV[2], "+inf") > 0 then
+	return 0
+end
+local size = tonumber(redis.call("HGET", KEYS[1], "size") or "0")
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("DECRBY", KEYS[3], size)
+return 1
+`)
+
+func entryKey(key string) string {
+	return KeyPrefix + "cache:entry:" + key
+}
+
+func lruKey() string {
+	return KeyPrefix + "cache:lru"
+}
+
+func sizeKey() string {
+	return KeyPrefix + "cache:size"
+}
+
+// CacheGet returns the cached entry for the key or nil if there is none
+func (s *Store) CacheGet(ctx context.Context, key string) (*CacheEntry, error) {
+	fields, err := s.rdb.HGetAll(ctx, entryKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(fields["size"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var ttl int64
+	if fields["ttl"] != "" {
+		ttl, err = strconv.ParseInt(fields["ttl"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry := &CacheEntry{
+		Key:        key,
+		Folder:     fields["folder"],
+		Size:       size,
+		AlbumId:    fields["album"],
+		Storefront: fields["storefront"],
+		Partial:    fields["partial"] == "1",
+		TTL:        time.Duration(ttl) * time.Millisecond,
+	}
+	if fields["kinds"] != "" {
+		entry.FailureKinds = strings.Split(fields["kinds"], ",")
+	}
+	return entry, nil
+}
+
+// CachePut adds a finished result to the cache and returns the total cache size
+func (s *Store) CachePut(ctx context.Context, entry *CacheEntry) (int64, error) {
+	return putEntry.Run(ctx, s.rdb,
+		[]string{entryKey(entry.Key), lruKey(), sizeKey()},
+		entry.Folder, entry.Size, time.Now().UnixMilli(), entry.Key, entry.TTL.Milliseconds(), entry.AlbumId, entry.Storefront, entry.Partial,
+		strings.Join(entry.FailureKinds, ","),
+	).Int64()
+}
+
+// CacheTouch marks the entry as recently used
+func (s *Store) CacheTouch(ctx context.Context, key string) error {
+	return s.rdb.ZAddXX(ctx, lruKey(), redis.Z{Score: float64(time.Now().UnixMilli()), Member: key}).Err()
+}
+
+// CacheDrop removes the entry from the index, returns false if it is still held
+func (s *Store) CacheDrop(ctx context.Context, entry *CacheEntry) (bool, error) {
+	dropped, err := dropEntry.Run(ctx, s.rdb,
+		[]string{entryKey(entry.Key), lruKey(), sizeKey(), holdersKey(entry.Key)},
+		entry.Key, time.Now().UnixMilli(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return dropped == 1, nil
+}
+
+// CacheSize returns the total size of all cached entries
+func (s *Store) CacheSize(ctx context.Context) (int64, error) {
+	size, err := s.rdb.Get(ctx, sizeKey()).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// CacheOldest returns up to n entries, least recently used first
+func (s *Store) CacheOldest(ctx context.Context, n int64) ([]*CacheEntry, error) {
+	keys, err := s.rdb.ZRange(ctx, lruKey(), 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*CacheEntry
+	for _, key := range keys {
+		entry, err := s.CacheGet(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			// index and entry went out of sync, the entry is gone anyway
+			s.rdb.ZRem(ctx, lruKey(), key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// CacheKeys returns the keys of all cached entries
+func (s *Store) CacheKeys(ctx context.Context) ([]string, error) {
+	return s.rdb.ZRange(ctx, lruKey(), 0, -1).Result()
+}
+
+// IsCached reports whether the key has a cache entry
+func (s *Store) IsCached(ctx context.Context, key string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, entryKey(key)).Result()
+	return n > 0, err
+}
+
+// CacheExpired returns the entries that haven't been used within their TTL
+func (s *Store) CacheExpired(ctx context.Context) ([]*CacheEntry, error) {
+	used, err := s.rdb.ZRangeWithScores(ctx, lruKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []*CacheEntry
+	for _, z := range used {
+		entry, err := s.CacheGet(ctx, z.Member.(string))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || entry.TTL == 0 {
+			continue
+		}
+		if time.Since(time.UnixMilli(int64(z.Score))) > entry.TTL {
+			expired = append(expired, entry)
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// IdempotentRecord is what a request with an idempotency key produced
+type IdempotentRecord struct {
+	// Hash of the request body, a key can't be reused for another body
+	Hash string `json:"hash"`
+	// Pending is set while the first request is still being handled
+	Pending bool            `json:"pending,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+}
+
+func idempotencyKey(key string) string {
+	return KeyPrefix + "idempotency:" + key
+}
+
+// BeginIdempotent reserves the key for a request with the given body hash, for at most ttl in case it's never released.
+// It returns nil if the request should be handled, or the record of an earlier request with the same key
+func (s *Store) BeginIdempotent(ctx context.Context, key string, hash string, ttl time.Duration) (*IdempotentRecord, error) {
+	pending, err := json.Marshal(IdempotentRecord{Hash: hash, Pending: true})
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.rdb.SetNX(ctx, idempotencyKey(key), pending, ttl).Result()
+	if err != nil || ok {
+		return nil, err
+	}
+
+	raw, err := s.rdb.Get(ctx, idempotencyKey(key)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	record := new(IdempotentRecord)
+	if err := json.Unmarshal(raw, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// FinishIdempotent stores the response for replays of the key
+func (s *Store) FinishIdempotent(ctx context.Context, key string, record *IdempotentRecord, window time.Duration) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, idempotencyKey(key), raw, window).Err()
+}
+
+// AbortIdempotent releases the key, so the request can be retried
+func (s *Store) AbortIdempotent(ctx context.Context, key string) error {
+	return s.rdb.Del(ctx, idempotencyKey(key)).Err()
+}
@@ -0,0 +1,254 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// earlyTTL is how long updates of a run are kept for its record, when the worker got to them first
+const earlyTTL = time.Hour
+
+// JobRecord is the history of a job, kept after asynq has forgotten the task.
+// Owner and the fields below it describe the latest run, the one Owner's submission started
+type JobRecord struct {
+	JobId      string          `json:"jobid"`
+	QueueId    string          `json:"queueid"`
+	Owner      string          `json:"owner"`
+	Url        string          `json:"url,omitempty"`
+	AlbumId    string          `json:"albumId"`
+	Storefront string          `json:"storefront"`
+	Options    json.RawMessage `json:"options,omitempty"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	// Result is the report of the rip, including the folder of the result
+	Result      json.RawMessage `json:"result,omitempty"`
+	SubmittedAt time.Time       `json:"submittedAt"`
+	StartedAt   *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time      `json:"finishedAt,omitempty"`
+	// Submissions are all submissions of the job while its history was kept, including the ones that
+	// were pointed at a running job or answered from the cache
+	Submissions []Submission `json:"submissions,omitempty"`
+	// Previous are earlier runs of the job, which ended failed or partial and were started over, oldest first
+	Previous []JobRecord `json:"previous,omitempty"`
+}
+
+// Submission is a single submission of a job
+type Submission struct {
+	Owner       string    `json:"owner"`
+	Url         string    `json:"url,omitempty"`
+	SubmittedAt time.Time `json:"submittedAt"`
+	// Outcome is queued, duplicate or cached, like in the audit log
+	Outcome string `json:"outcome"`
+}
+
+func jobKey(jobId string) string {
+	return KeyPrefix + "job:" + jobId
+}
+
+func jobSubmissionsKey(jobId string) string {
+	return jobKey(jobId) + ":submissions"
+}
+
+func jobRunsKey(jobId string) string {
+	return jobKey(jobId) + ":runs"
+}
+
+// jobEarlyKey holds the updates of a run whose record hasn't been written yet
+func jobEarlyKey(jobId string) string {
+	return jobKey(jobId) + ":early"
+}
+
+// createJob replaces the record with the one of a new run, which takes the updates the worker made before it.
+// ARGV holds the submission time of the run, the ttl in ms and the fields of the record
+var createJob = redis.NewScript(`
+local early = {}
+if redis.call("HGET", KEYS[2], "submitted") == ARGV[1] then
+	early = redis.call("HGETALL", KEYS[2])
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+redis.call("HSET", KEYS[1], unpack(ARGV, 3))
+if #early > 0 then
+	redis.call("HSET", KEYS[1], unpack(early))
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// updateJob sets fields of the record of a run. Updates of a run without a record yet are kept aside for it,
+// those of runs submitted before records were kept, which have an empty submission time, are dropped.
+// ARGV holds the submission time of the run, the ttl of early updates in ms and the fields
+var updateJob = redis.NewScript(`
+local key = KEYS[1]
+if ARGV[1] == "" then
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+elseif redis.call("HGET", KEYS[1], "submitted") ~= ARGV[1] then
+	key = KEYS[2]
+	if redis.call("HGET", KEYS[2], "submitted") ~= ARGV[1] then
+		redis.call("DEL", KEYS[2])
+	end
+	redis.call("HSET", KEYS[2], "submitted", ARGV[1])
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+redis.call("HSET", key, unpack(ARGV, 3))
+return 1
+`)
+
+// runStamp identifies a run of a job by its submission time
+func runStamp(submitted time.Time) string {
+	if submitted.IsZero() {
+		return ""
+	}
+	return submitted.UTC().Format(time.RFC3339Nano)
+}
+
+// CreateJob records a new run of the job once it has been enqueued, with the updates its worker may have made already.
+// The record of an earlier run with the same ID moves to the previous runs. The record is kept for ttl, 0 keeps it forever
+func (s *Store) CreateJob(ctx context.Context, record *JobRecord, ttl time.Duration) error {
+	previous, err := s.jobRun(ctx, record.JobId)
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		raw, err := json.Marshal(previous)
+		if err != nil {
+			return err
+		}
+		pipe := s.rdb.TxPipeline()
+		pipe.RPush(ctx, jobRunsKey(record.JobId), raw)
+		if ttl > 0 {
+			pipe.Expire(ctx, jobRunsKey(record.JobId), ttl)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	return createJob.Run(ctx, s.rdb, []string{jobKey(record.JobId), jobEarlyKey(record.JobId)},
+		runStamp(record.SubmittedAt), ttl.Milliseconds(),
+		"queue", record.QueueId,
+		"owner", record.Owner,
+		"url", record.Url,
+		"album", record.AlbumId,
+		"storefront", record.Storefront,
+		"options", []byte(record.Options),
+		"status", record.Status,
+		"submitted", runStamp(record.SubmittedAt),
+	).Err()
+}
+
+func (s *Store) updateJob(ctx context.Context, jobId string, run time.Time, values ...any) error {
+	args := append([]any{runStamp(run), earlyTTL.Milliseconds()}, values...)
+	return updateJob.Run(ctx, s.rdb, []string{jobKey(jobId), jobEarlyKey(jobId)}, args...).Err()
+}
+
+// JobStarted records that a worker picked up the run of the job submitted at run
+func (s *Store) JobStarted(ctx context.Context, jobId string, run time.Time, status string) error {
+	return s.updateJob(ctx, jobId, run, "status", status, "started", time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// JobMoved records that the job moved to another queue before it started
+func (s *Store) JobMoved(ctx context.Context, jobId string, run time.Time, queue string) error {
+	return s.updateJob(ctx, jobId, run, "queue", queue)
+}
+
+// JobFailed records a failed attempt of the job, status tells whether it will be retried
+func (s *Store) JobFailed(ctx context.Context, jobId string, run time.Time, status string, errMsg string) error {
+	return s.updateJob(ctx, jobId, run, "status", status, "error", errMsg)
+}
+
+// JobFinished records the outcome of the job once it won't run again
+func (s *Store) JobFinished(ctx context.Context, jobId string, run time.Time, status string, errMsg string, result []byte) error {
+	return s.updateJob(ctx, jobId, run,
+		"status", status,
+		"error", errMsg,
+		"result", result,
+		"finished", time.Now().UTC().Format(time.RFC3339Nano),
+	)
+}
+
+// AddSubmission appends a submission to the history of the job, which is kept for ttl, 0 keeps it forever
+func (s *Store) AddSubmission(ctx context.Context, jobId string, submission Submission, ttl time.Duration) error {
+	raw, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.RPush(ctx, jobSubmissionsKey(jobId), raw)
+	if ttl > 0 {
+		pipe.Expire(ctx, jobSubmissionsKey(jobId), ttl)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetJob returns the record of the job with its submissions and earlier runs, or nil if there is none
+func (s *Store) GetJob(ctx context.Context, jobId string) (*JobRecord, error) {
+	record, err := s.jobRun(ctx, jobId)
+	if err != nil || record == nil {
+		return record, err
+	}
+
+	submissions, err := s.rdb.LRange(ctx, jobSubmissionsKey(jobId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range submissions {
+		var submission Submission
+		if err := json.Unmarshal([]byte(raw), &submission); err == nil {
+			record.Submissions = append(record.Submissions, submission)
+		}
+	}
+
+	runs, err := s.rdb.LRange(ctx, jobRunsKey(jobId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range runs {
+		var run JobRecord
+		if err := json.Unmarshal([]byte(raw), &run); err == nil {
+			record.Previous = append(record.Previous, run)
+		}
+	}
+	return record, nil
+}
+
+// jobRun returns the latest run of the job, or nil if there is none
+func (s *Store) jobRun(ctx context.Context, jobId string) (*JobRecord, error) {
+	fields, err := s.rdb.HGetAll(ctx, jobKey(jobId)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+
+	record := &JobRecord{
+		JobId:      jobId,
+		QueueId:    fields["queue"],
+		Owner:      fields["owner"],
+		Url:        fields["url"],
+		AlbumId:    fields["album"],
+		Storefront: fields["storefront"],
+		Status:     fields["status"],
+		Error:      fields["error"],
+	}
+	if fields["options"] != "" {
+		record.Options = json.RawMessage(fields["options"])
+	}
+	if fields["result"] != "" {
+		record.Result = json.RawMessage(fields["result"])
+	}
+	record.SubmittedAt, _ = time.Parse(time.RFC3339Nano, fields["submitted"])
+	if started, err := time.Parse(time.RFC3339Nano, fields["started"]); err == nil {
+		record.StartedAt = &started
+	}
+	if finished, err := time.Parse(time.RFC3339Nano, fields["finished"]); err == nil {
+		record.FinishedAt = &finished
+	}
+	return record, nil
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyPrefix starts every key of the store. Redis Cluster needs a hash tag here, since the scripts
+// build some of their keys themselves and all of them have to be in the same slot
+var KeyPrefix = "ripper-api:"
+
+type Store struct {
+	rdb redis.UniversalClient
+}
+
+func New(opt asynq.RedisConnOpt) (*Store, error) {
+	rdb, ok := opt.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		return nil, errors.New("unsupported redis connection options")
+	}
+	return &Store{rdb: rdb}, nil
+}
+
+func (s *Store) Close() error {
+	return s.rdb.Close()
+}
+
+// holdersKey scores the holders of a result with the time their hold runs out
+func holdersKey(key string) string {
+	return KeyPrefix + "holds:" + key
+}
+
+func claimKey(taskId string) string {
+	return KeyPrefix + "claim:" + taskId
+}
+
+// ClaimTask binds a task ID to a queue, returning the queue of an earlier claim if there is one
+func (s *Store) ClaimTask(ctx context.Context, taskId string, queue string, ttl time.Duration) (string, error) {
+	ok, err := s.rdb.SetNX(ctx, claimKey(taskId), queue, ttl).Result()
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return queue, nil
+	}
+	return s.rdb.Get(ctx, claimKey(taskId)).Result()
+}
+
+// holdResult extends the hold of the holder, the key lives as long as the longest hold
+var holdResult = redis.NewScript(`
+redis.call("ZADD", KEYS[1], "GT", ARGV[2], ARGV[1])
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[1], last[2])
+return 1
+`)
+
+// moveClaim rebinds a task ID to another queue, as long as it is still bound to the expected one
+var moveClaim = redis.NewScript(`
+local queue = redis.call("GET", KEYS[1])
+if queue and queue ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+// MoveClaim binds a task ID claimed for one queue to another, returns false if it's claimed for a third one by now
+func (s *Store) MoveClaim(ctx context.Context, taskId string, from string, to string, ttl time.Duration) (bool, error) {
+	moved, err := moveClaim.Run(ctx, s.rdb, []string{claimKey(taskId)}, from, to, ttl.Milliseconds()).Int()
+	return moved == 1, err
+}
+
+// HoldResult keeps the result from being evicted until the time given, a holder's hold is only ever extended
+func (s *Store) HoldResult(ctx context.Context, key string, holder string, until time.Time) error {
+	return holdResult.Run(ctx, s.rdb, []string{holdersKey(key)}, holder, until.UnixMilli()).Err()
+}
+
+// ReleaseResult drops a holder of the result before its hold runs out
+func (s *Store) ReleaseResult(ctx context.Context, key string, holder string) error {
+	return s.rdb.ZRem(ctx, holdersKey(key), holder).Err()
+}
+
+// ClaimedQueue returns the queue a task ID has been claimed for, or an empty string
+func (s *Store) ClaimedQueue(ctx context.Context, taskId string) (string, error) {
+	queue, err := s.rdb.Get(ctx, claimKey(taskId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return queue, err
+}
+
+// IsHeld reports whether any hold on the result is still running
+func (s *Store) IsHeld(ctx context.Context, key string) (bool, error) {
+	n, err := s.rdb.ZCount(ctx, holdersKey(key), strconv.FormatInt(time.Now().UnixMilli(), 10), "+inf").Result()
+	return n > 0, err
+}
@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenKey holds the developer token of the catalog API, shared by the api and all workers
+func tokenKey() string {
+	return KeyPrefix + "token"
+}
+
+// SetToken caches the developer token for ttl
+func (s *Store) SetToken(ctx context.Context, token string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, tokenKey(), token, ttl).Err()
+}
+
+// Token returns the cached developer token, or "" if there is none
+func (s *Store) Token(ctx context.Context) (string, error) {
+	token, err := s.rdb.Get(ctx, tokenKey()).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return token, err
+}
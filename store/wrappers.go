@@ -0,0 +1,314 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Wrapper is how a pooled wrapper takes rips
+type Wrapper struct {
+	// Slots is the number of tracks the wrapper decrypts at once
+	Slots int `json:"slots"`
+	// Weight favors the wrapper over less weighted ones with the same load
+	Weight int `json:"weight"`
+	// Labels reserve the wrapper for jobs asking for one of them, a wrapper without labels takes any job
+	Labels []string `json:"labels,omitempty"`
+}
+
+// parseWrapper reads a pool entry, entries from before weights and labels only hold the slots
+func parseWrapper(raw string) (Wrapper, error) {
+	if slots, err := strconv.Atoi(raw); err == nil {
+		return Wrapper{Slots: slots, Weight: 1}, nil
+	}
+	var w Wrapper
+	err := json.Unmarshal([]byte(raw), &w)
+	w.Weight = max(w.Weight, 1)
+	return w, err
+}
+
+func (w Wrapper) marshal() (string, error) {
+	w.Weight = max(w.Weight, 1)
+	raw, err := json.Marshal(w)
+	return string(raw), err
+}
+
+// WrapperHealth is the outcome of the latest probes of a wrapper
+type WrapperHealth struct {
+	// Failures is the number of probes that failed in a row
+	Failures  int       `json:"failures"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Error     string    `json:"error,omitempty"`
+	// Quarantined wrappers don't get any new leases until a probe succeeds again
+	Quarantined bool `json:"quarantined"`
+}
+
+// leaseWrapper drops expired leases and leases a slot on the wrapper with room left that is neither quarantined
+// nor draining and would be the least busy, by weight, with the lease. Labelled wrappers are only leased to jobs
+// with one of their labels. Returns nil if every wrapper is busy
+var leaseWrapper = redis.NewScript(`
+local function settings(raw)
+	local slots = tonumber(raw)
+	if slots then
+		return slots, 1, {}
+	end
+	local wrapper = cjson.decode(raw)
+	local labels = wrapper.labels
+	if type(labels) ~= "table" then
+		labels = {}
+	end
+	return wrapper.slots, math.max(wrapper.weight or 1, 1), labels
+end
+
+local function serves(labels, label)
+	if #labels == 0 then
+		return true
+	end
+	for _, l in ipairs(labels) do
+		if l == label then
+			return true
+		end
+	end
+	return false
+end
+
+local pool = redis.call("HGETALL", KEYS[1])
+local best, bestLoad, fallback
+local others = 0
+for i = 1, #pool, 2 do
+	local leases = ARGV[4] .. pool[i]
+	local slots, weight, labels = settings(pool[i + 1])
+	redis.call("ZREMRANGEBYSCORE", leases, "-inf", ARGV[1])
+	local used = redis.call("ZCARD", leases)
+	local load = (used + 1) / (slots * weight)
+	local excluded = redis.call("SISMEMBER", KEYS[2], pool[i]) == 1 or redis.call("SISMEMBER", KEYS[3], pool[i]) == 1
+	if not excluded and serves(labels, ARGV[5]) then
+		if pool[i] == ARGV[6] then
+			if used < slots then
+				fallback = pool[i]
+			end
+		else
+			others = others + 1
+			if used < slots and (best == nil or load < bestLoad) then
+				best, bestLoad = pool[i], load
+			end
+		end
+	end
+end
+-- the avoided wrapper is only used when no other one could take the job
+if best == nil and others == 0 then
+	best = fallback
+end
+if best == nil then
+	return false
+end
+redis.call("ZADD", ARGV[4] .. best, ARGV[2], ARGV[3])
+return best
+`)
+
+// wrapperPoolKey maps wrapper addresses to their settings
+func wrapperPoolKey() string {
+	return KeyPrefix + "wrappers"
+}
+
+func quarantineKey() string {
+	return KeyPrefix + "wrappers:quarantine"
+}
+
+// configuredKey holds the wrappers the config pooled on the latest start
+func configuredKey() string {
+	return KeyPrefix + "wrappers:configured"
+}
+
+// drainingKey holds wrappers that finish their rips but get no new ones
+func drainingKey() string {
+	return KeyPrefix + "wrappers:draining"
+}
+
+func healthKey() string {
+	return KeyPrefix + "wrappers:health"
+}
+
+func leasesPrefix() string {
+	return KeyPrefix + "wrapper:leases:"
+}
+
+// leasesKey is a sorted set of the jobs holding a slot of the wrapper, scored by lease expiry
+func leasesKey(addr string) string {
+	return leasesPrefix() + addr
+}
+
+// RegisterWrappers makes the pool match the configured wrappers: they are pooled with the configured settings,
+// and wrappers configured on an earlier start but no longer are removed. Draining and quarantine are kept,
+// wrappers added through the admin API alone are left alone
+func (s *Store) RegisterWrappers(ctx context.Context, wrappers map[string]Wrapper) error {
+	previous, err := s.rdb.SMembers(ctx, configuredKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := s.rdb.TxPipeline()
+	for _, addr := range previous {
+		if _, ok := wrappers[addr]; !ok {
+			removeWrapper(ctx, pipe, addr)
+		}
+	}
+	pipe.Del(ctx, configuredKey())
+	for addr, w := range wrappers {
+		raw, err := w.marshal()
+		if err != nil {
+			return err
+		}
+		pipe.HSet(ctx, wrapperPoolKey(), addr, raw)
+		pipe.SAdd(ctx, configuredKey(), addr)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// AddWrapper adds the wrapper to the pool or changes its settings, a draining wrapper takes new rips again
+func (s *Store) AddWrapper(ctx context.Context, addr string, w Wrapper) error {
+	raw, err := w.marshal()
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, wrapperPoolKey(), addr, raw)
+	pipe.SRem(ctx, drainingKey(), addr)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DrainWrapper stops new leases of the wrapper, returns false if it isn't pooled
+func (s *Store) DrainWrapper(ctx context.Context, addr string) (bool, error) {
+	ok, err := s.rdb.HExists(ctx, wrapperPoolKey(), addr).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, s.rdb.SAdd(ctx, drainingKey(), addr).Err()
+}
+
+// RemoveWrapper drops the wrapper from the pool, returns false if it wasn't pooled.
+// Rips still running on it keep their lease until they are done
+func (s *Store) RemoveWrapper(ctx context.Context, addr string) (bool, error) {
+	pipe := s.rdb.TxPipeline()
+	removed := removeWrapper(ctx, pipe, addr)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+// removeWrapper queues the removal of the wrapper with all its state, the returned command counts the removed entries
+func removeWrapper(ctx context.Context, pipe redis.Pipeliner, addr string) *redis.IntCmd {
+	removed := pipe.HDel(ctx, wrapperPoolKey(), addr)
+	pipe.SRem(ctx, drainingKey(), addr)
+	pipe.SRem(ctx, quarantineKey(), addr)
+	pipe.HDel(ctx, healthKey(), addr)
+	return removed
+}
+
+// DrainingWrappers returns the wrappers that are being drained
+func (s *Store) DrainingWrappers(ctx context.Context) ([]string, error) {
+	return s.rdb.SMembers(ctx, drainingKey()).Result()
+}
+
+// LeaseWrapper leases a slot of a wrapper serving label to the job for ttl, or returns an empty string if all
+// slots are taken. The wrapper avoid is passed over as long as there are other wrappers serving label
+func (s *Store) LeaseWrapper(ctx context.Context, jobId string, label string, avoid string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	addr, err := leaseWrapper.Run(ctx, s.rdb,
+		[]string{wrapperPoolKey(), quarantineKey(), drainingKey()},
+		now.UnixMilli(), now.Add(ttl).UnixMilli(), jobId, leasesPrefix(), label, avoid,
+	).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return addr, err
+}
+
+func failedWrapperKey(jobId string) string {
+	return KeyPrefix + "wrapper:failed:" + jobId
+}
+
+// SetFailedWrapper remembers the wrapper the job lost for ttl, so its next attempt can avoid it
+func (s *Store) SetFailedWrapper(ctx context.Context, jobId string, addr string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, failedWrapperKey(jobId), addr, ttl).Err()
+}
+
+// FailedWrapper returns the wrapper the job lost last, or an empty string
+func (s *Store) FailedWrapper(ctx context.Context, jobId string) (string, error) {
+	addr, err := s.rdb.Get(ctx, failedWrapperKey(jobId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return addr, err
+}
+
+// RenewLease extends the lease of the job on the wrapper by ttl
+func (s *Store) RenewLease(ctx context.Context, addr string, jobId string, ttl time.Duration) error {
+	return s.rdb.ZAddXX(ctx, leasesKey(addr), redis.Z{Score: float64(time.Now().Add(ttl).UnixMilli()), Member: jobId}).Err()
+}
+
+// ReleaseWrapper gives the slot leased by the job back to the pool
+func (s *Store) ReleaseWrapper(ctx context.Context, addr string, jobId string) error {
+	return s.rdb.ZRem(ctx, leasesKey(addr), jobId).Err()
+}
+
+// Wrappers returns the addresses of the pooled wrappers with their settings
+func (s *Store) Wrappers(ctx context.Context) (map[string]Wrapper, error) {
+	pool, err := s.rdb.HGetAll(ctx, wrapperPoolKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	wrappers := make(map[string]Wrapper, len(pool))
+	for addr, raw := range pool {
+		wrappers[addr], err = parseWrapper(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wrappers, nil
+}
+
+// WrapperLeases returns the jobs currently holding a slot of the wrapper
+func (s *Store) WrapperLeases(ctx context.Context, addr string) ([]string, error) {
+	return s.rdb.ZRangeByScore(ctx, leasesKey(addr), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+// WrapperHealth returns the health of the wrapper, or nil if it hasn't been probed yet
+func (s *Store) WrapperHealth(ctx context.Context, addr string) (*WrapperHealth, error) {
+	raw, err := s.rdb.HGet(ctx, healthKey(), addr).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	health := new(WrapperHealth)
+	return health, json.Unmarshal(raw, health)
+}
+
+// SetWrapperHealth records the health of the wrapper and takes it in or out of quarantine
+func (s *Store) SetWrapperHealth(ctx context.Context, addr string, health *WrapperHealth) error {
+	raw, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, healthKey(), addr, raw)
+	if health.Quarantined {
+		pipe.SAdd(ctx, quarantineKey(), addr)
+	} else {
+		pipe.SRem(ctx, quarantineKey(), addr)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	st, err := New(asynq.RedisClientOpt{Addr: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func addWrappers(t *testing.T, st *Store, wrappers map[string]Wrapper) {
+	t.Helper()
+	for addr, w := range wrappers {
+		if err := st.AddWrapper(context.Background(), addr, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func lease(t *testing.T, st *Store, jobId string, label string, avoid string, ttl time.Duration) string {
+	t.Helper()
+	addr, err := st.LeaseWrapper(context.Background(), jobId, label, avoid, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestLeaseWrapper(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("acquire and release", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{"w1:10020": {Slots: 1, Weight: 1}})
+
+		if got := lease(t, st, "job1", "normal", "", time.Minute); got != "w1:10020" {
+			t.Fatalf("first lease = %q, want w1:10020", got)
+		}
+		if got := lease(t, st, "job2", "normal", "", time.Minute); got != "" {
+			t.Fatalf("lease of a full wrapper = %q, want none", got)
+		}
+		if err := st.ReleaseWrapper(ctx, "w1:10020", "job1"); err != nil {
+			t.Fatal(err)
+		}
+		if got := lease(t, st, "job2", "normal", "", time.Minute); got != "w1:10020" {
+			t.Fatalf("lease after release = %q, want w1:10020", got)
+		}
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{"w1:10020": {Slots: 1, Weight: 1}})
+
+		if got := lease(t, st, "job1", "normal", "", 50*time.Millisecond); got != "w1:10020" {
+			t.Fatalf("first lease = %q, want w1:10020", got)
+		}
+		if err := st.RenewLease(ctx, "w1:10020", "job1", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if got := lease(t, st, "job2", "normal", "", time.Minute); got != "" {
+			t.Fatalf("lease of a renewed slot = %q, want none", got)
+		}
+		leases, err := st.WrapperLeases(ctx, "w1:10020")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leases) != 1 || leases[0] != "job1" {
+			t.Fatalf("leases = %v, want [job1]", leases)
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{"w1:10020": {Slots: 1, Weight: 1}})
+
+		if got := lease(t, st, "job1", "normal", "", 50*time.Millisecond); got != "w1:10020" {
+			t.Fatalf("first lease = %q, want w1:10020", got)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if got := lease(t, st, "job2", "normal", "", time.Minute); got != "w1:10020" {
+			t.Fatalf("lease after expiry = %q, want w1:10020", got)
+		}
+		// renewing an expired lease doesn't take the slot back
+		if err := st.RenewLease(ctx, "w1:10020", "job1", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		leases, err := st.WrapperLeases(ctx, "w1:10020")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leases) != 1 || leases[0] != "job2" {
+			t.Fatalf("leases = %v, want [job2]", leases)
+		}
+	})
+
+	t.Run("least loaded", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{
+			"w1:10020": {Slots: 2, Weight: 1},
+			"w2:10020": {Slots: 2, Weight: 3},
+		})
+
+		got := []string{
+			lease(t, st, "job1", "normal", "", time.Minute),
+			lease(t, st, "job2", "normal", "", time.Minute),
+			lease(t, st, "job3", "normal", "", time.Minute),
+		}
+		want := []string{"w2:10020", "w2:10020", "w1:10020"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("leases = %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{"w1:10020": {Slots: 1, Weight: 1, Labels: []string{"high"}}})
+
+		if got := lease(t, st, "job1", "normal", "", time.Minute); got != "" {
+			t.Fatalf("lease of a reserved wrapper = %q, want none", got)
+		}
+		if got := lease(t, st, "job2", "high", "", time.Minute); got != "w1:10020" {
+			t.Fatalf("lease with the label = %q, want w1:10020", got)
+		}
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{"w1:10020": {Slots: 1, Weight: 1}})
+
+		if _, err := st.DrainWrapper(ctx, "w1:10020"); err != nil {
+			t.Fatal(err)
+		}
+		if got := lease(t, st, "job1", "normal", "", time.Minute); got != "" {
+			t.Fatalf("lease of a draining wrapper = %q, want none", got)
+		}
+	})
+
+	t.Run("avoid", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{
+			"w1:10020": {Slots: 1, Weight: 3},
+			"w2:10020": {Slots: 1, Weight: 1},
+		})
+
+		if got := lease(t, st, "job1", "normal", "w1:10020", time.Minute); got != "w2:10020" {
+			t.Fatalf("lease avoiding w1 = %q, want w2:10020", got)
+		}
+		// the other wrapper is busy, which is worth waiting for
+		if got := lease(t, st, "job2", "normal", "w1:10020", time.Minute); got != "" {
+			t.Fatalf("lease avoiding w1 while w2 is busy = %q, want none", got)
+		}
+	})
+
+	t.Run("avoid the only wrapper", func(t *testing.T) {
+		st := newTestStore(t)
+		addWrappers(t, st, map[string]Wrapper{"w1:10020": {Slots: 1, Weight: 1}})
+
+		if got := lease(t, st, "job1", "normal", "w1:10020", time.Minute); got != "w1:10020" {
+			t.Fatalf("lease avoiding the only wrapper = %q, want w1:10020", got)
+		}
+	})
+}